@@ -5,201 +5,1402 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"hash/fnv"
+	"io"
+	"log"
+	"log/slog"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
+
+	"github.com/rhcarvalho/go-build-variants/variants"
 )
 
-var versions = []string{
-	"go1.10.8",
-	"go1.11.13",
-	"go1.12.17",
-	"go1.13.8",
-	"go1.14",
+func main() {
+	log.SetFlags(0)
+	name := flag.String("name", "hello", "program `name` used as prefix for output files; ignored with multiple -src targets")
+	flag.StringVar(&variants.Out, "out", variants.Out, "output `dir`ectory")
+	timestampedOut := flag.Bool("timestamped-out", false, "write outputs to a subdirectory of the output directory named after the time of the run, linked as latest")
+	flag.BoolVar(&variants.ContentAddressed, "cas", variants.ContentAddressed, "store outputs by digest in the cas subdirectory of the output directory, named by symlinks in its refs subdirectory")
+	flag.StringVar(&variants.Layout, "layout", variants.Layout, "arrangement of outputs in the output directory: flat, or nested in goos/goarch subdirectories")
+	srcList := flag.String("src", "main.go", "comma-separated `list` of source files or packages to build")
+	modMode := flag.String("mod", "", "module download `mode` vendor, readonly or mod, set with GOFLAGS for go1.11 and later")
+	buildDir := flag.String("dir", "", "run builds in `dir`ectory, such as that of another module, resolving -src in it")
+	flag.DurationVar(&variants.Timeout, "timeout", variants.Timeout, "maximum `duration` of each build or toolchain download")
+	flag.DurationVar(&variants.Timeout, "timeout-per-step", variants.Timeout, "alias of -timeout")
+	timeoutTotal := flag.Duration("timeout-total", 0, "maximum `duration` of the whole run, after which remaining builds are canceled, or 0 for no limit")
+	flag.IntVar(&variants.Retries, "retries", variants.Retries, "retry failed toolchain downloads up to `n` times")
+	dryRun := flag.Bool("dry-run", false, "print the build commands without running them")
+	list := flag.Bool("list", false, "print the configurations to build and their outputs, as JSON lines with -json, without building")
+	verify := flag.Bool("verify-reproducible", false, "build each configuration twice and report whether the outputs are identical")
+	failNonReproducible := flag.Bool("fail-on-nonreproducible", false, "with -verify-reproducible, fail if configurations with -trimpath, stripping and -buildvcs=false are not reproducible")
+	timings := flag.Bool("timings", false, "print how long each build took")
+	pkg := flag.String("package", "", "bundle the outputs of each Go version and platform into an archive of `format` tar.gz or zip; windows outputs are always zipped")
+	pkgFiles := flag.String("package-files", "", "comma-separated `list` of files, such as README and LICENSE, to add to each archive")
+	compression := flag.String("compress", "upx", "compress outputs with `method` upx, gzip, zstd or none")
+	upxLevel := flag.String("upx-level", "", "upx compression `level`: 1 to 9, best, brute, ultra-brute or lzma, named in compressed outputs such as -upx9; the upx default if empty")
+	extraLDFlags := flag.String("ldflags", "", "extra linker `flags` appended to the generated ones")
+	clean := flag.Bool("clean", false, "remove the output directory before building")
+	cache := flag.Bool("cache", false, "skip builds whose output already exists and was built from the current sources")
+	matrixFile := flag.String("config", "", "JSON `file` describing the matrix to build, see MatrixSpec")
+	linkMode := flag.String("linkmode", "", "build only with link `mode` internal or external instead of sweeping both")
+	noStripSweep := flag.Bool("no-strip-sweep", false, "build only unstripped outputs instead of sweeping stripping")
+	noTrimPathSweep := flag.Bool("no-trimpath-sweep", false, "build only without -trimpath instead of sweeping it")
+	jobs := flag.Int("jobs", defaultJobs(), "number of builds to run in `parallel`, 0 means unbounded")
+	tags := flag.String("tags", "", "semicolon-separated `list` of build tag sets, such as netgo;netgo,osusergo, to also build with")
+	experiments := flag.String("experiments", "", "comma-separated `list` of GOEXPERIMENT values to also build with")
+	jsonEvents := flag.Bool("json", false, "emit build events as JSON lines instead of human-readable output")
+	only := flag.String("only", "", "build only configurations matching the comma-separated key=value `selectors`, such as goos=windows,linkmode=external")
+	skip := flag.String("skip", "", "skip configurations matching the comma-separated key=value `selectors`")
+	provenance := flag.Bool("provenance", false, "write a provenance.json file recording the host, toolchains, commit, times and artifact digests of the run")
+	sbom := flag.Bool("sbom", false, "write a CycloneDX SBOM next to each output")
+	tests := flag.Bool("test", false, "also build test binaries with go test -c")
+	outputTmpl := flag.String("output-template", "", "text/template `text` naming outputs from Config fields, such as {{.Name}}_{{.GOOS}}_{{.GOARCH}}{{ext .}}")
+	warnings := flag.String("warnings", "show", "how to handle compiler and linker warnings of successful builds: show, error or ignore")
+	buildVCS := flag.String("buildvcs", "", "pass -buildvcs=`value` (auto, true or false) to go1.18 and later, default false with -trimpath or -verify-reproducible")
+	vars := make(keyValueFlag)
+	flag.Var(vars, "X", "set the string variable `name=value`, such as main.version=1.0, when linking; may be repeated")
+	extraEnv := make(keyValueFlag)
+	flag.Var(extraEnv, "env", "set the environment variable `KEY=VALUE` for build commands; may be repeated")
+	du := flag.Bool("du", false, "print the disk usage of the output directory and the largest and smallest outputs")
+	sanitizers := flag.String("sanitizers", "", "comma-separated `list` of sanitizers, msan or asan, to also build with")
+	incremental := flag.Bool("incremental", false, "report which configurations have no output yet and build only those, implies -cache")
+	check := flag.Bool("check", false, "report which Go versions are installed and exit without building")
+	checkUpdates := flag.Bool("check-updates", false, "report Go releases newer than the listed versions, failing if any, and exit without building")
+	install := flag.Bool("install", false, "with -check, install missing toolchains instead of failing")
+	injectGoVersion := flag.Bool("inject-goversion", false, "set the main.goVersion variable to the Go version of each build")
+	noInfo := flag.Bool("no-info", false, "do not set the main.info, main.commit and main.dirty variables describing the build, for programs without them")
+	noBuildTime := flag.Bool("no-buildtime", false, "do not embed the build time in outputs")
+	var maxSize sizeFlag
+	flag.Var(&maxSize, "max-size", "fail builds whose output is larger than `size`, such as 20MB or 512KB")
+	maxSizeCompressed := flag.Bool("max-size-compressed", false, "with -max-size, check the size of compressed outputs, if any")
+	noOutput := flag.Bool("no-output", false, "discard outputs, only checking that configurations build, without compressing, checksums nor size reports")
+	bench := flag.Int("bench", 0, "build each configuration `n` times, rebuilding all packages, and report statistics of the build durations instead of outputs")
+	maxFailures := flag.Int("max-failures", 0, "stop building after `n` builds fail, or never if 0")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimum `level` of log messages: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log message `format`: text or json")
+	postBuild := flag.String("post-build", "", "shell `command` run for each successful output, a text/template over PostBuild such as \"setcap cap_net_bind_service=+ep {{.Path}}\"")
+	postBuildFailure := flag.String("post-build-failure", "error", "how to handle failing -post-build commands: error or warn")
+	codesign := flag.String("codesign", "", "sign darwin outputs with codesign using `identity`, - for ad-hoc signing; only on macOS")
+	fips := flag.Bool("fips", false, "also build in FIPS 140 mode, with GOFIPS140 (go1.24 and later) or GOEXPERIMENT=boringcrypto (go1.19 and later, linux/amd64 and linux/arm64 with cgo)")
+	static := flag.Bool("static", false, "also build statically linked linux outputs with cgo and the external linker")
+	cover := flag.Bool("cover", false, "also build with coverage instrumentation (go1.20 and later)")
+	coverPkg := flag.String("coverpkg", "", "with -cover, instrument the comma-separated `patterns` instead of the main module")
+	sinceLast := flag.Bool("since-last", false, "build nothing if sources, configurations and output options are unchanged since the last successful run")
+	force := flag.Bool("force", false, "with -since-last, build even if nothing changed")
+	winres := flag.String("winres", "", "embed Windows resources in windows outputs of package targets from comma-separated .syso `files` named like rsrc_windows_amd64.syso, one per GOARCH, or a goversioninfo versioninfo.json file")
+	overlay := flag.String("overlay", "", "also build with the overlay `file` replacing source files, as for go build -overlay (go1.16 and later)")
+	pgo := flag.String("pgo", "", "also build with the CPU profile `file` for profile-guided optimization (go1.21 and later)")
+	versionList := flag.String("versions", strings.Join(variants.DefaultMatrix.Versions, ","), "comma-separated `list` of Go versions, overriding the matrix")
+	latestPatch := flag.Bool("latest-patch", false, "build each listed Go version at the newest patch release of its minor version, such as go1.21.13 for go1.21")
+	withTip := flag.Bool("tip", false, "also build with "+variants.Tip+", the development toolchain, to catch regressions early")
+	flag.Parse()
+	// Neither listing nor printing commands builds, so they need no
+	// toolchain installs nor a clean output directory.
+	noBuild := *dryRun || *list
+	if abs, err := filepath.Abs(variants.Out); err != nil {
+		log.Fatalf("resolving output directory: %v", err)
+	} else {
+		variants.Out = abs
+	}
+	targets := strings.Split(*srcList, ",")
+	for _, target := range targets {
+		if *winres != "" && strings.HasSuffix(target, ".go") {
+			// A list of .go files builds a package of just those files,
+			// leaving out the .syso files in their directory.
+			fmt.Fprintf(os.Stderr, "-winres needs package targets, such as -src ., not %s\n", target)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	// On a terminal, show a progress bar, keeping it below log messages.
+	var bar *progressBar
+	var logOutput io.Writer = os.Stderr
+	if !*jsonEvents && isTerminal(os.Stdout) {
+		bar = &progressBar{w: os.Stdout}
+		logOutput = bar
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch *logFormat {
+	case "text":
+		// Timestamps are noise when watching a run interactively.
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+		variants.Logger = slog.New(slog.NewTextHandler(logOutput, opts))
+	case "json":
+		variants.Logger = slog.New(slog.NewJSONHandler(logOutput, opts))
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -log-format %q\n", *logFormat)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *outputTmpl != "" {
+		t, err := variants.ParseOutputTemplate(*outputTmpl)
+		if err != nil {
+			log.Fatalf("invalid -output-template: %v", err)
+		}
+		if err := t.Execute(io.Discard, &variants.Config{}); err != nil {
+			log.Fatalf("invalid -output-template: %v", err)
+		}
+		variants.OutputTemplate = t
+	}
+	var postBuildTmpl *template.Template
+	if *postBuild != "" {
+		t, err := template.New("post-build").Option("missingkey=error").Parse(*postBuild)
+		if err == nil {
+			err = t.Execute(io.Discard, variants.PostBuild{})
+		}
+		if err != nil {
+			log.Fatalf("invalid -post-build: %v", err)
+		}
+		postBuildTmpl = t
+	}
+	switch *postBuildFailure {
+	case "error", "warn":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -post-build-failure value %q\n", *postBuildFailure)
+		flag.Usage()
+		os.Exit(2)
+	}
+	for name, value := range vars {
+		if s := name + "=" + value; strings.Contains(s, "'") && strings.Contains(s, `"`) {
+			log.Fatalf("invalid -X %s: cannot contain both single and double quotes", s)
+		}
+	}
+	onlySel, err := variants.ParseSelector(*only)
+	if err != nil {
+		log.Fatalf("invalid -only: %v", err)
+	}
+	skipSel, err := variants.ParseSelector(*skip)
+	if err != nil {
+		log.Fatalf("invalid -skip: %v", err)
+	}
+	var events *variants.Events
+	if *jsonEvents {
+		events = variants.NewEvents(os.Stdout)
+		variants.Stdout = io.Discard
+	}
+
+	matrix := variants.DefaultMatrix
+	if *matrixFile != "" {
+		matrix, err = variants.LoadMatrix(*matrixFile)
+		if err != nil {
+			log.Fatalf("loading matrix: %v", err)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "versions" {
+			matrix.Versions = strings.Split(*versionList, ",")
+		}
+	})
+	if *withTip {
+		matrix.Versions = append(matrix.Versions, variants.Tip)
+	}
+	// Flags pinning a dimension override the matrix file, so that a focused
+	// investigation does not need a file of its own.
+	switch *linkMode {
+	case "":
+	case "internal", "external":
+		matrix.LinkModes = []string{*linkMode}
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -linkmode value %q\n", *linkMode)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *noStripSweep {
+		matrix.Strip = []bool{false}
+	}
+	if *noTrimPathSweep {
+		matrix.TrimPath = []bool{false}
+	}
+	if *pgo != "" {
+		matrix.PGO = []string{"", *pgo}
+	}
+	if *overlay != "" {
+		matrix.Overlays = []string{"", *overlay}
+	}
+	if *buildDir != "" {
+		// Builds run in another directory, while file names given to
+		// this program are relative to the current one.
+		for _, paths := range [][]string{matrix.PGO, matrix.Overlays} {
+			for i, path := range paths {
+				if path != "" && !filepath.IsAbs(path) {
+					abs, err := filepath.Abs(path)
+					if err != nil {
+						log.Fatal(err)
+					}
+					paths[i] = abs
+				}
+			}
+		}
+	}
+	if *static {
+		matrix.Static = []bool{false, true}
+	}
+	if *fips {
+		matrix.FIPS = []bool{false, true}
+	}
+	if *cover {
+		matrix.Cover = []bool{false, true}
+	}
+	if *tests {
+		matrix.Kinds = []string{"", "test"}
+	}
+	if *sanitizers != "" {
+		matrix.Sanitizers = append([]string{""}, strings.Split(*sanitizers, ",")...)
+	}
+	var available []string
+	for _, sanitizer := range matrix.Sanitizers {
+		switch sanitizer {
+		case "", "asan":
+		case "msan":
+			if _, err := exec.LookPath("clang"); err != nil {
+				variants.Logger.Warn("clang not available, skipping msan builds")
+				continue
+			}
+		default:
+			log.Fatalf("unknown sanitizer %q", sanitizer)
+		}
+		available = append(available, sanitizer)
+	}
+	matrix.Sanitizers = available
+	if *experiments != "" {
+		matrix.Experiments = append([]string{""}, strings.Split(*experiments, ",")...)
+	}
+	if *tags != "" {
+		matrix.Tags = append([]string{""}, strings.Split(*tags, ";")...)
+	}
+	for _, profile := range matrix.PGO {
+		if profile == "" {
+			continue
+		}
+		if _, err := os.Stat(profile); err != nil {
+			log.Fatalf("invalid PGO profile: %v", err)
+		}
+	}
+
+	buildTime := time.Now()
+	var root string // output directory containing timestamped ones
+	if *timestampedOut {
+		root = variants.Out
+		// RFC 3339, with dashes instead of colons, which Windows does not
+		// allow in file names.
+		variants.Out = filepath.Join(root, buildTime.UTC().Format("2006-01-02T15-04-05Z"))
+	}
+	commit, dirty := gitInfo(*buildDir)
+	if *noOutput {
+		*compression = "none"
+	}
+	switch *compression {
+	case "upx":
+		if exec.Command("upx", "-V").Run() != nil {
+			variants.Logger.Warn("upx not available, outputs will not be compressed")
+			*compression = "none"
+			break
+		}
+		if *upxLevel == "" {
+			break
+		}
+		if variants.UPXOption(*upxLevel) == "" {
+			fmt.Fprintf(os.Stderr, "invalid -upx-level value %q\n", *upxLevel)
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := variants.CheckUPXOption(variants.UPXOption(*upxLevel)); err != nil {
+			log.Fatalf("-upx-level %s: %v", *upxLevel, err)
+		}
+	case "zstd":
+		if _, err := exec.LookPath("zstd"); err != nil {
+			variants.Logger.Warn("zstd not available, outputs will not be compressed")
+			*compression = "none"
+		}
+	case "gzip", "none":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -compress method %q\n", *compression)
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch *buildVCS {
+	case "", "auto", "true", "false":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -buildvcs value %q\n", *buildVCS)
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch *warnings {
+	case "show", "error", "ignore":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -warnings value %q\n", *warnings)
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch *pkg {
+	case "", "tar.gz", "zip":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -package value %q\n", *pkg)
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch *modMode {
+	case "", "readonly", "mod":
+	case "vendor":
+		if fi, err := os.Stat(filepath.Join(*buildDir, "vendor")); err != nil || !fi.IsDir() {
+			log.Fatalf("-mod=vendor: no vendor directory, see go mod vendor")
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -mod value %q\n", *modMode)
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch variants.Layout {
+	case "flat", "nested":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -layout value %q\n", variants.Layout)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Cancel all running commands on interrupt. A second interrupt terminates
+	// the program immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *timeoutTotal > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, *timeoutTotal, variants.ErrTotalTimeout)
+		defer cancelTimeout()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		variants.Logger.Warn("interrupted, cleaning up")
+		cancel()
+	}()
+
+	if *latestPatch {
+		releases, err := variants.GoReleases(ctx)
+		if err != nil {
+			log.Fatalf("listing Go releases: %v", err)
+		}
+		matrix.Versions, err = variants.LatestPatches(matrix.Versions, releases)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *checkUpdates {
+		releases, err := variants.GoReleases(ctx)
+		if err != nil {
+			log.Fatalf("listing Go releases: %v", err)
+		}
+		if printUpdates(matrix.Versions, releases) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *check {
+		missing := checkToolchains(matrix.Versions)
+		if len(missing) > 0 && *install {
+			if err := variants.InstallMissingToolchains(ctx, missing); err != nil {
+				log.Fatal(err)
+			}
+			missing = nil
+		}
+		if len(missing) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *clean && !noBuild {
+		if err := cleanOutput(); err != nil {
+			log.Fatalf("cleaning output directory: %v", err)
+		}
+	}
+	if !noBuild {
+		if err := variants.InstallMissingToolchains(ctx, matrix.Versions); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// In verify mode, builds must not embed the build time, or else no two
+	// builds would be identical.
+	cfgTime := buildTime
+	if *verify || *noBuildTime {
+		cfgTime = time.Time{}
+	}
+
+	b := &variants.Builder{
+		Compression:       *compression,
+		UPXLevel:          *upxLevel,
+		Cache:             (*cache || *incremental) && !*noOutput,
+		Verify:            *verify,
+		SBOM:              *sbom,
+		Warnings:          *warnings,
+		MaxSize:           int64(maxSize),
+		MaxSizeCompressed: *maxSizeCompressed,
+		MaxFailures:       *maxFailures,
+		Rebuild:           *bench > 0,
+		NoOutput:          *noOutput,
+		PostBuild:         postBuildTmpl,
+		PostBuildWarn:     *postBuildFailure == "warn",
+		CodeSign:          *codesign,
+		Events:            events,
+	}
+	if bar != nil {
+		b.Progress = bar
+	}
+	if b.Cache {
+		if err := b.Cached.Read(filepath.Join(variants.Out, "SHA256SUMS")); err != nil {
+			log.Fatalf("reading checksums: %v", err)
+		}
+	}
+	toolchains := make(map[string]int)  // Go minor version of each toolchain
+	versions := make(map[string]string) // Go version of each toolchain path
+	for _, exe := range matrix.Versions {
+		version := exe
+		// Toolchain paths tell nothing about their version, so they are
+		// checked even when not building.
+		if !noBuild || variants.IsToolchainPath(exe) {
+			var err error
+			version, err = variants.GoVersion(exe)
+			if err != nil {
+				log.Fatalf("checking toolchain %s: %v", exe, err)
+			}
+		}
+		if variants.IsToolchainPath(exe) {
+			versions[exe] = version
+		} else if !variants.VersionMatches(exe, version) {
+			log.Fatalf("inconsistent go version: exe=%q, version=%q", exe, version)
+		}
+		if exe == variants.Tip {
+			// Whichever release tip precedes, it is newer than
+			// all of them.
+			version = variants.Tip
+		}
+		v, err := variants.MinorVersion(version)
+		if err != nil {
+			log.Fatalf("checking toolchain %s: %v", exe, err)
+		}
+		toolchains[exe] = v
+	}
+
+	// Drop platforms unknown to the newest toolchain, which would otherwise
+	// fail deep in the compiler.
+	var newest string
+	for exe, v := range toolchains {
+		if newest == "" || v > toolchains[newest] {
+			newest = exe
+		}
+	}
+	if supported, err := variants.DistList(newest); err != nil {
+		if !noBuild {
+			variants.Logger.Warn("cannot list supported platforms", "toolchain", newest, "err", err)
+		}
+	} else {
+		var platforms []variants.Platform
+		for _, p := range matrix.Platforms {
+			if !supported[p] {
+				variants.Logger.Warn("skipping unsupported platform", "goos", p.GOOS, "goarch", p.GOARCH, "toolchain", newest)
+				continue
+			}
+			platforms = append(platforms, p)
+		}
+		matrix.Platforms = platforms
+	}
+
+	// Sanitizers are only available on a few platforms, so say why builds
+	// requested with them are missing.
+	for _, sanitizer := range matrix.Sanitizers {
+		if sanitizer == "" {
+			continue
+		}
+		for _, p := range matrix.Platforms {
+			var unsupported []string
+			for _, version := range matrix.Versions {
+				if !variants.SanitizerSupported(sanitizer, p.GOOS, p.GOARCH, toolchains[version]) {
+					unsupported = append(unsupported, version)
+				}
+			}
+			switch {
+			case runtime.GOOS != p.GOOS || runtime.GOARCH != p.GOARCH:
+				variants.Logger.Warn("skipping sanitizer builds: cannot cross-compile", "sanitizer", sanitizer, "goos", p.GOOS, "goarch", p.GOARCH)
+			case len(unsupported) > 0:
+				variants.Logger.Warn("skipping sanitizer builds: not supported", "sanitizer", sanitizer, "goos", p.GOOS, "goarch", p.GOARCH, "goversions", strings.Join(unsupported, ","))
+			}
+		}
+	}
+
+	var cfgs []variants.Config
+	var total int
+	for _, target := range targets {
+		// With multiple targets, outputs are named after their targets so that
+		// they do not collide.
+		prefix := *name
+		if len(targets) > 1 {
+			prefix = targetName(*buildDir, target)
+		}
+		for _, cfg := range matrix.Expand(toolchains) {
+			cfg.Name = prefix
+			cfg.Package = target
+			cfg.Dir = *buildDir
+			cfg.GitCommit = commit
+			cfg.GitDirty = dirty
+			cfg.BuildTime = cfgTime
+			cfg.ExtraLDFlags = *extraLDFlags
+			if len(extraEnv) > 0 {
+				cfg.ExtraEnv = extraEnv
+			}
+			if len(vars) > 0 {
+				cfg.Vars = vars
+			}
+			cfg.NoInfo = *noInfo
+			cfg.InjectGoVersion = *injectGoVersion
+			if cfg.GOOS == "windows" {
+				cfg.WinRes = *winres
+			}
+			if toolchains[cfg.GoVersion] >= 11 {
+				// modules were added in go1.11
+				cfg.ModMode = *modMode
+			}
+			if toolchains[cfg.GoVersion] >= 18 {
+				switch {
+				case *buildVCS != "":
+					cfg.BuildVCS = *buildVCS
+				case *verify:
+					cfg.BuildVCS = "false"
+				}
+			}
+			if cfg.Cover {
+				if *verify {
+					// Coverage counters are not reproducible.
+					continue
+				}
+				cfg.CoverPkg = *coverPkg
+			}
+			if version, ok := versions[cfg.GoVersion]; ok {
+				cfg.Toolchain = cfg.GoVersion
+				cfg.GoVersion = version
+			}
+			if err := cfg.Validate(); err != nil {
+				variants.Logger.Debug("skipping configuration", "output", cfg.OutputPath(), "reason", err)
+				continue
+			}
+			total++
+			if (onlySel != nil && !onlySel.Matches(&cfg)) || (skipSel != nil && skipSel.Matches(&cfg)) {
+				continue
+			}
+			cfgs = append(cfgs, cfg)
+		}
+	}
+	if onlySel != nil || skipSel != nil {
+		fmt.Fprintf(variants.Stdout, "%d of %d configurations match the filter\n", len(cfgs), total)
+	}
+	// Identical configurations, such as from the same Go version listed
+	// twice, would have concurrent builds write the same output. Different
+	// configurations may also map to the same output path, such as with an
+	// -output-template omitting varying fields.
+	hashes := make(map[string]bool)
+	paths := make(map[string]bool)
+	unique := cfgs[:0]
+	for _, cfg := range cfgs {
+		if hashes[cfg.Hash()] {
+			continue
+		}
+		if paths[cfg.OutputPath()] {
+			log.Fatalf("several configurations are written to %s", cfg.OutputPath())
+		}
+		hashes[cfg.Hash()] = true
+		paths[cfg.OutputPath()] = true
+		unique = append(unique, cfg)
+	}
+	if n := len(cfgs) - len(unique); n > 0 {
+		variants.Logger.Warn("skipping duplicate configurations", "count", n)
+	}
+	cfgs = unique
+	for _, cfg := range cfgs {
+		if !cfg.CGOEnabled && variants.CGOTags(cfg.Tags) {
+			variants.Logger.With(cfg.LogAttrs()...).Info("build tags have no effect without cgo", "tags", cfg.Tags)
+		}
+	}
+	if !noBuild || *incremental {
+		var err error
+		b.Sources, err = variants.HashSources(*buildDir)
+		if err != nil {
+			log.Fatalf("hashing sources: %v", err)
+		}
+	}
+	if *incremental {
+		// Since the output path embeds a hash of the configuration, outputs
+		// exist only for configurations built before, and their cache entry
+		// only if built from the current sources. Existing outputs are still
+		// recorded in the manifest, as with -cache.
+		var missing []variants.Config
+		for _, cfg := range cfgs {
+			if ok, err := variants.CacheHit(b.Sources, &cfg); err != nil {
+				log.Fatalf("checking cache: %v", err)
+			} else if !ok {
+				missing = append(missing, cfg)
+			}
+		}
+		fmt.Fprintf(variants.Stdout, "%d new configurations to build, %d already built\n", len(missing), len(cfgs)-len(missing))
+		if noBuild {
+			cfgs = missing
+		}
+	}
+	if *list {
+		printList(cfgs, *jsonEvents)
+		return
+	}
+
+	var stamp string
+	// The stamp is kept out of timestamped output directories, or else each
+	// run would look for it in a new directory.
+	stampPath := filepath.Join(variants.Out, ".buildstamp")
+	if root != "" {
+		stampPath = filepath.Join(root, ".buildstamp")
+	}
+	if *sinceLast {
+		options := []string{
+			"compress=" + *compression,
+			"upx-level=" + *upxLevel,
+			"sbom=" + strconv.FormatBool(*sbom),
+			"package=" + *pkg,
+			"package-files=" + *pkgFiles,
+			"provenance=" + strconv.FormatBool(*provenance),
+			"post-build=" + *postBuild,
+			"codesign=" + *codesign,
+			"cas=" + strconv.FormatBool(variants.ContentAddressed),
+			"layout=" + variants.Layout,
+			"output-template=" + *outputTmpl,
+		}
+		var err error
+		stamp, err = buildStamp(*buildDir, cfgs, options)
+		if err != nil {
+			log.Fatalf("computing build stamp: %v", err)
+		}
+		if b, err := os.ReadFile(stampPath); err == nil && string(b) == stamp && !*force {
+			variants.Logger.Info("sources, configurations and options unchanged since the last run, nothing to build")
+			return
+		}
+	}
+	if *dryRun {
+		for _, cfg := range cfgs {
+			fmt.Fprintf(variants.Stdout, "# %s\n%s\n", cfg.OutputPath(), cfg.CommandLine())
+		}
+		return
+	}
+	if root != "" {
+		if err := linkLatest(root, variants.Out); err != nil {
+			variants.Logger.Warn("cannot link the latest output directory", "err", err)
+		}
+	}
+	var generated []string
+	if *winres != "" {
+		var err error
+		generated, err = variants.WriteWinRes(*winres, *buildDir, targets, matrix.Platforms)
+		if err != nil {
+			removeAll(generated)
+			log.Fatalf("embedding Windows resources: %v", err)
+		}
+	}
+	if *bench > 0 {
+		err := runBench(ctx, b, cfgs, *jobs, *bench)
+		removeAll(generated)
+		if err != nil {
+			if context.Cause(ctx) == variants.ErrTotalTimeout {
+				variants.Logger.Error("run timed out, canceled remaining builds", "timeout-total", *timeoutTotal)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	summary, err := b.BuildAll(ctx, cfgs, *jobs)
+	removeAll(generated)
+	if err != nil {
+		if context.Cause(ctx) == variants.ErrTotalTimeout {
+			variants.Logger.Error("run timed out, canceled remaining builds", "timeout-total", *timeoutTotal, "finished", len(summary), "canceled", len(cfgs)-len(summary))
+		}
+		os.Exit(1)
+	}
+	if *timings {
+		printTimings(summary, time.Since(buildTime))
+	}
+	if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+		if err := writeStepSummary(path, summary); err != nil {
+			variants.Logger.Warn("writing GitHub Actions job summary", "err", err)
+		}
+	}
+	if *verify {
+		unexpected := printReproducibility(summary)
+		if !printSummary(summary) || (unexpected > 0 && *failNonReproducible) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *noOutput {
+		if !printSummary(summary) {
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprint(variants.Stdout, variants.SizeReport(summary))
+	fmt.Fprint(variants.Stdout, variants.CompressionReport(summary))
+	variants.LogIneffectiveStrip(summary)
+	if *du {
+		if err := printDiskUsage(summary, 5); err != nil {
+			log.Fatalf("computing disk usage: %v", err)
+		}
+	}
+	if *pkg != "" {
+		var extra []string
+		if *pkgFiles != "" {
+			extra = strings.Split(*pkgFiles, ",")
+		}
+		archives, err := variants.PackageOutputs(summary, *pkg, extra)
+		if err != nil {
+			log.Fatalf("packaging outputs: %v", err)
+		}
+		for _, path := range archives {
+			if err := b.Checksums.Add(path); err != nil {
+				log.Fatalf("packaging outputs: %v", err)
+			}
+		}
+	}
+
+	var built []variants.Config
+	for _, r := range summary {
+		built = append(built, r.Config)
+	}
+	if envs, err := variants.ToolchainEnvs(ctx, built); err != nil {
+		variants.Logger.Warn("cannot record toolchain environments in the manifest", "err", err)
+	} else {
+		b.Manifest.Toolchains = envs
+	}
+	if err := b.Manifest.Write(filepath.Join(variants.Out, "manifest.json")); err != nil {
+		log.Fatalf("writing manifest: %v", err)
+	}
+	if err := b.Checksums.Write(filepath.Join(variants.Out, "SHA256SUMS")); err != nil {
+		log.Fatalf("writing checksums: %v", err)
+	}
+	if *provenance {
+		if err := variants.WriteProvenance(filepath.Join(variants.Out, "provenance.json"), buildTime, commit, dirty, summary, b.Checksums.Digests()); err != nil {
+			log.Fatalf("writing provenance: %v", err)
+		}
+	}
+	if !printSummary(summary) {
+		os.Exit(1)
+	}
+	if *sinceLast {
+		if err := os.WriteFile(stampPath, []byte(stamp), 0644); err != nil {
+			log.Fatalf("writing build stamp: %v", err)
+		}
+	}
 }
 
-const out = "dist"
+// gitInfo returns the commit hash of the git repository in dir, or the current
+// directory if empty, and whether its working tree has uncommitted changes. Outside of a
+// git repository, the commit is empty.
+func gitInfo(dir string) (commit string, dirty bool) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	if err != nil {
+		return "", false
+	}
+	commit = string(bytes.TrimSpace(b))
+	cmd = exec.Command("git", "status", "--porcelain")
+	cmd.Dir = dir
+	b, err = cmd.Output()
+	if err != nil {
+		return commit, false
+	}
+	return commit, len(bytes.TrimSpace(b)) > 0
+}
 
-type Config struct {
-	Name       string
-	GoVersion  string
-	GOOS       string
-	LinkMode   string
-	StripDebug bool
-	TrimPath   bool
-	BuildTime  time.Time
+// targetName returns a name for the source file or package target, relative
+// to dir, such as "server" for "./cmd/server" or "main" for "main.go". The
+// target "." is named after dir, the working directory if empty.
+func targetName(dir, target string) string {
+	name := strings.TrimSuffix(path.Base(filepath.ToSlash(target)), ".go")
+	if name == "." || name == "/" {
+		if abs, err := filepath.Abs(filepath.Join(dir, target)); err == nil {
+			name = filepath.Base(abs)
+		}
+	}
+	return name
+}
+
+// linkLatest creates the output directory out, within root, and points the
+// symbolic link root/latest to it, replacing any previous one.
+func linkLatest(root, out string) error {
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	latest := filepath.Join(root, "latest")
+	tmp := latest + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(out), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, latest)
 }
 
-func (c *Config) Cmd() *exec.Cmd {
-	b, err := json.MarshalIndent(c, "", "  ")
+// removeAll removes the files at paths, ignoring errors.
+func removeAll(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// buildStamp returns a digest of the sources in dir, see HashSources, of the
+// output paths of the configurations cfgs and of the options producing other
+// artifacts from the outputs, such as compressed copies and archives. Outputs and artifacts
+// built by a successful run are up to date as long as the stamp is unchanged.
+func buildStamp(dir string, cfgs []variants.Config, options []string) (string, error) {
+	sources, err := variants.HashSources(dir)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	ldflags := fmt.Sprintf("-X 'main.info=%s' -linkmode=%s", b, c.LinkMode)
-	if c.StripDebug {
-		ldflags += " -s -w"
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", sources)
+	for _, opt := range options {
+		fmt.Fprintf(h, "%s\n", opt)
 	}
-	args := []string{
-		"build",
-		"-o", c.OutputPath(),
-		"-ldflags", ldflags,
+	var paths []string
+	for _, cfg := range cfgs {
+		paths = append(paths, cfg.OutputPath())
 	}
-	if c.TrimPath {
-		args = append(args, "-trimpath")
+	sort.Strings(paths)
+	fmt.Fprintf(h, "%s\n", strings.Join(paths, " "))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// keyValueFlag is a repeatable flag collecting KEY=VALUE pairs, such as -env
+// and -X.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	var kvs []string
+	for k, v := range f {
+		kvs = append(kvs, k+"="+v)
 	}
-	args = append(args, "main.go")
-	cmd := exec.Command(c.GoVersion, args...)
-	cmd.Env = append(os.Environ(), fmt.Sprintf("GOOS=%s", c.GOOS))
-	return cmd
+	sort.Strings(kvs)
+	return strings.Join(kvs, " ")
 }
 
-func (c *Config) OutputPath() string {
-	name := fmt.Sprintf("%s-%s-%s-%slnk", c.Name, c.GoVersion, c.GOOS, c.LinkMode[:3])
-	if c.StripDebug {
-		name += "-strip"
+func (f keyValueFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("%q is not in KEY=VALUE format", s)
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
+
+// sizeFlag is a flag holding a size in bytes, given as a number optionally
+// followed by one of the units B, KB, MB or GB, in powers of 1024.
+type sizeFlag int64
+
+func (f *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*f), 10)
+}
+
+func (f *sizeFlag) Set(s string) error {
+	units := []struct {
+		suffix string
+		size   float64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	num, unit := strings.ToUpper(strings.TrimSpace(s)), 1.0
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, unit = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.size
+			break
+		}
 	}
-	if c.TrimPath {
-		name += "-trimpath"
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
 	}
+	*f = sizeFlag(n * unit)
+	return nil
+}
 
-	// Append a hash of the config to the file name such that whenever the
-	// config changes we generate a new name, regardless of other parts of the
-	// file name. We ignore the c.BuildTime, otherwise every build would have a
-	// different hash. The intention is that rebuilding the same configuration
-	// overwrites an old output binary.
-	snapshot := *c
-	snapshot.BuildTime = time.Time{}
-	b, err := json.Marshal(snapshot)
+// cleanOutput removes everything in the output directory. To avoid accidents,
+// it refuses to clean directories that are not within the working directory.
+func cleanOutput() error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(variants.Out)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(wd); err == nil {
+		wd = resolved
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to clean %s: not within the working directory", variants.Out)
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		panic(err)
+		return err
 	}
-	h := fnv.New32a()
-	h.Write(b)
-	name += "-" + hex.EncodeToString(h.Sum(nil))
+	for _, e := range entries {
+		path := filepath.Join(variants.Out, e.Name())
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+		variants.Logger.Info("removed", "path", path)
+	}
+	return nil
+}
 
-	if c.GOOS == "windows" {
-		name += ".exe"
+// defaultJobs returns the default number of builds to run in parallel. Since
+// each build already runs its compilation steps in parallel, running one build
+// per CPU would overload the machine.
+func defaultJobs() int {
+	n := runtime.GOMAXPROCS(0) / 2
+	if n < 1 {
+		n = 1
 	}
-	return filepath.Join(out, name)
+	return n
 }
 
-func goVersion(exe string) string {
-	b, err := exec.Command(exe, "version").Output()
-	if err != nil {
-		panic(err)
+// progressBar shows on a terminal how many builds finished, and estimates
+// when the remaining ones will, based on the average time per finished build.
+// It is safe for concurrent use. Writes to a progressBar, such as log
+// messages, go to stderr above the bar.
+type progressBar struct {
+	mu    sync.Mutex
+	w     io.Writer // terminal where the bar is drawn
+	total int
+	done  int
+	start time.Time
+}
+
+// Start draws the bar for total builds.
+func (p *progressBar) Start(total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total, p.done, p.start = total, 0, time.Now()
+	p.draw()
+}
+
+// Finished records that a build finished and redraws the bar.
+func (p *progressBar) Finished() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.draw()
+}
+
+// Clear erases the bar, so that it stops being redrawn.
+func (p *progressBar) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(p.w, "\r\033[K")
+	p.total = 0
+}
+
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(p.w, "\r\033[K")
+	n, err := os.Stderr.Write(b)
+	p.draw()
+	return n, err
+}
+
+// draw draws the bar, if started, over the current line. The caller must
+// hold p.mu.
+func (p *progressBar) draw() {
+	if p.total == 0 {
+		return
 	}
-	version := string(bytes.Fields(b)[2])
-	return version
+	eta := "?"
+	if p.done > 0 {
+		avg := time.Since(p.start) / time.Duration(p.done)
+		eta = (avg * time.Duration(p.total-p.done)).Round(time.Second).String()
+	}
+	fmt.Fprintf(p.w, "\r\033[K[%d/%d] %d%%, ETA %s", p.done, p.total, p.done*100/p.total, eta)
 }
 
-func main() {
-	buildTime := time.Now()
-	name := "hello"
-	hasUPX := exec.Command("upx", "-V").Run() == nil
-
-	installMissingToolchains(versions)
-
-	sem := make(chan struct{}, runtime.NumCPU())
-	for _, exe := range versions {
-		for _, GOOS := range []string{"linux", "darwin", "windows"} {
-			for _, trimpath := range []bool{false, true} {
-				for _, linkmode := range []string{"internal", "external"} {
-					for _, strip := range []bool{false, true} {
-						version := goVersion(exe)
-						if version != exe {
-							panic(fmt.Errorf("inconsistent go version: exe=%q, version=%q", exe, version))
-						}
-
-						v, err := strconv.Atoi(strings.Split(version, ".")[1])
-						if err != nil {
-							panic(err)
-						}
-						if trimpath && v < 13 {
-							// -trimpath was added in go1.13
-							continue
-						}
-						if linkmode == "external" && runtime.GOOS != GOOS {
-							// cannot cross-compile using external linker
-							continue
-						}
-						cfg := Config{
-							Name:       name,
-							GoVersion:  version,
-							GOOS:       GOOS,
-							LinkMode:   linkmode,
-							StripDebug: strip,
-							TrimPath:   trimpath,
-							BuildTime:  buildTime,
-						}
-						sem <- struct{}{}
-						go func() {
-							fmt.Println(cfg.OutputPath())
-							mustRunCmd(cfg.Cmd())
-							if hasUPX {
-								upx(cfg.OutputPath())
-							}
-							<-sem
-						}()
-					}
-				}
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printReproducibility prints which configurations produced identical outputs
+// when built twice, telling apart those expected to be reproducible, see
+// Config.Reproducible, from the others. It returns the number of
+// configurations expected to be reproducible that were not.
+func printReproducibility(results []variants.Result) (unexpected int) {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Config.OutputPath() < results[j].Config.OutputPath()
+	})
+	var ok, exempt int
+	for _, r := range results {
+		if len(r.Digests) != 2 {
+			continue
+		}
+		switch {
+		case r.Digests[0] == r.Digests[1]:
+			ok++
+			fmt.Fprintf(variants.Stdout, "reproducible     %s\n", r.Config.OutputPath())
+		case r.Config.Reproducible():
+			unexpected++
+			fmt.Fprintf(variants.Stdout, "NOT reproducible %s: %s != %s\n", r.Config.OutputPath(), r.Digests[0], r.Digests[1])
+		default:
+			exempt++
+			fmt.Fprintf(variants.Stdout, "not reproducible %s (not expected to be)\n", r.Config.OutputPath())
+		}
+	}
+	fmt.Fprintf(variants.Stdout, "%d reproducible, %d not reproducible though expected to be, %d not expected to be\n", ok, unexpected, exempt)
+	return unexpected
+}
+
+// printList prints the key fields and output path of each of cfgs, sorted by
+// output path, as a table or, if asJSON, as JSON lines with the whole
+// configuration. The build time is left out, so that the list only changes
+// with the configurations.
+func printList(cfgs []variants.Config, asJSON bool) {
+	sorted := append([]variants.Config(nil), cfgs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].OutputPath() < sorted[j].OutputPath()
+	})
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, cfg := range sorted {
+			cfg.BuildTime = time.Time{}
+			enc.Encode(struct {
+				OutputPath string
+				Config     variants.Config
+			}{cfg.OutputPath(), cfg})
+		}
+		return
+	}
+	w := tabwriter.NewWriter(variants.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "GOVERSION\tGOOS\tGOARCH\tLINKMODE\tCGO\tSTRIP\tTRIMPATH\tBUILDMODE\tOUTPUT\n")
+	for _, cfg := range sorted {
+		buildmode := cfg.BuildMode
+		if buildmode == "" {
+			buildmode = "exe"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\t%t\t%s\t%s\n", cfg.GoVersion, cfg.GOOS, cfg.GOARCH,
+			cfg.LinkMode, cfg.CGOEnabled, cfg.StripDebug, cfg.TrimPath, buildmode, cfg.OutputPath())
+	}
+	w.Flush()
+}
+
+// printTimings prints how long each build took, slowest first. Because builds
+// run concurrently, their durations overlap and the total wall-clock time of
+// the run, elapsed, is usually shorter than the sum of the build durations.
+func printTimings(results []variants.Result, elapsed time.Duration) {
+	var built []variants.Result
+	var total time.Duration
+	for _, r := range results {
+		if r.Duration > 0 {
+			built = append(built, r)
+			total += r.Duration
+		}
+	}
+	sort.Slice(built, func(i, j int) bool {
+		return built[i].Duration > built[j].Duration
+	})
+	for _, r := range built {
+		fmt.Fprintf(variants.Stdout, "%8.1fs  %s\n", r.Duration.Seconds(), r.Config.OutputPath())
+	}
+	if len(built) > 0 {
+		avg := total / time.Duration(len(built))
+		fmt.Fprintf(variants.Stdout, "%d builds: total %.1fs, average %.1fs, wall-clock %.1fs\n",
+			len(built), total.Seconds(), avg.Seconds(), elapsed.Seconds())
+	}
+}
+
+// runBench builds cfgs n times and prints the minimum, median, maximum and
+// standard deviation of the build durations of each configuration, slowest
+// median first, followed by the configurations that failed. Outputs are
+// overwritten by each round of builds. The error is not nil only if ctx is
+// done before all builds finish.
+func runBench(ctx context.Context, b *variants.Builder, cfgs []variants.Config, jobs, n int) error {
+	durations := make(map[string][]time.Duration)
+	failed := make(map[string]error)
+	for i := 0; i < n; i++ {
+		variants.Logger.Info("benchmark round", "round", i+1, "rounds", n)
+		results, err := b.BuildAll(ctx, cfgs, jobs)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			path := r.Config.OutputPath()
+			if r.Err != nil {
+				failed[path] = r.Err
+				continue
 			}
+			durations[path] = append(durations[path], r.Duration)
+		}
+	}
+	type stats struct {
+		path               string
+		min, med, max, dev time.Duration
+	}
+	var all []stats
+	for path, ds := range durations {
+		if _, ok := failed[path]; ok {
+			continue
+		}
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		var sum float64
+		for _, d := range ds {
+			sum += float64(d)
+		}
+		mean := sum / float64(len(ds))
+		var sq float64
+		for _, d := range ds {
+			sq += (float64(d) - mean) * (float64(d) - mean)
+		}
+		med := ds[len(ds)/2]
+		if len(ds)%2 == 0 {
+			med = (ds[len(ds)/2-1] + ds[len(ds)/2]) / 2
+		}
+		all = append(all, stats{path, ds[0], med, ds[len(ds)-1], time.Duration(math.Sqrt(sq / float64(len(ds))))})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].med != all[j].med {
+			return all[i].med > all[j].med
 		}
+		return all[i].path < all[j].path
+	})
+	w := tabwriter.NewWriter(variants.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "MIN\tMEDIAN\tMAX\tSTDDEV\tOUTPUT\n")
+	for _, s := range all {
+		fmt.Fprintf(w, "%.2fs\t%.2fs\t%.2fs\t%.2fs\t%s\n",
+			s.min.Seconds(), s.med.Seconds(), s.max.Seconds(), s.dev.Seconds(), s.path)
 	}
-	for n := cap(sem); n > 0; n-- {
-		sem <- struct{}{}
+	w.Flush()
+	var paths []string
+	for path := range failed {
+		paths = append(paths, path)
 	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(variants.Stdout, "FAIL %s: %v\n", path, failed[path])
+	}
+	fmt.Fprintf(variants.Stdout, "%d configurations, %d rounds, %d failed\n", len(cfgs), n, len(failed))
+	return nil
 }
 
-// installMissingToolchains takes a list of Go versions (in go1.x[.x] format)
-// and installs toolchains that are not available locally.
-func installMissingToolchains(versions []string) {
-	for _, version := range versions {
-		installed := func() string {
-			defer func() {
-				recover()
-			}()
-			return goVersion(version)
-		}()
-		if installed != version {
-			fmt.Println("installing", version)
-			mustRun("go", "get", "golang.org/dl/"+version)
-			mustRun(version, "download")
+// printDiskUsage prints the total size of the files in the output directory,
+// followed by the n largest and n smallest outputs of successful builds.
+func printDiskUsage(results []variants.Result, n int) error {
+	var total int64
+	err := filepath.Walk(variants.Out, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var built []variants.Result
+	for _, r := range results {
+		if r.Err == nil {
+			built = append(built, r)
 		}
 	}
+	sort.Slice(built, func(i, j int) bool {
+		return built[i].Size > built[j].Size
+	})
+	if n > len(built) {
+		n = len(built)
+	}
+	fmt.Fprintf(variants.Stdout, "%s: %d bytes\n", variants.Out, total)
+	fmt.Fprintln(variants.Stdout, "largest outputs:")
+	for _, r := range built[:n] {
+		fmt.Fprintf(variants.Stdout, "%12d  %s\n", r.Size, r.Config.OutputPath())
+	}
+	fmt.Fprintln(variants.Stdout, "smallest outputs:")
+	for i := len(built) - 1; i >= len(built)-n; i-- {
+		fmt.Fprintf(variants.Stdout, "%12d  %s\n", built[i].Size, built[i].Config.OutputPath())
+	}
+	return nil
 }
 
-// upx compresses an executable with upx, leaving the original intact.
-func upx(exe string) {
-	out := strings.TrimSuffix(exe, ".exe")
-	out += "-upx"
-	if strings.HasSuffix(exe, ".exe") {
-		out += ".exe"
+// writeStepSummary appends a Markdown table of the results to path, the job
+// summary file of a GitHub Actions step.
+func writeStepSummary(path string, results []variants.Result) error {
+	sorted := append([]variants.Result(nil), results...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Config.OutputPath() < sorted[j].Config.OutputPath()
+	})
+	var buf bytes.Buffer
+	var failed int
+	fmt.Fprintln(&buf, "| Status | Output | Size | Compressed | Duration |")
+	fmt.Fprintln(&buf, "| --- | --- | ---: | ---: | ---: |")
+	for _, r := range sorted {
+		status, size, compressed := "ok", strconv.FormatInt(r.Size, 10), "-"
+		if r.Err != nil {
+			failed++
+			status = "FAIL: " + strings.ReplaceAll(strings.ReplaceAll(r.Err.Error(), "|", "\\|"), "\n", " ")
+			size = "-"
+		}
+		if r.CompressedSize > 0 {
+			compressed = strconv.FormatInt(r.CompressedSize, 10)
+		}
+		fmt.Fprintf(&buf, "| %s | `%s` | %s | %s | %.1fs |\n",
+			status, r.Config.OutputPath(), size, compressed, r.Duration.Seconds())
+	}
+	fmt.Fprintf(&buf, "\n%d succeeded, %d failed\n", len(results)-failed, failed)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
 	}
-	fmt.Println(out)
-	mustRun("upx", "-qq", "-f", "-o", out, exe)
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-// mustRun runs the command with the given name and arguments and panics if the
-// execution failed.
-func mustRun(name string, arg ...string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, name, arg...)
-	mustRunCmd(cmd)
+// printSummary prints which configurations succeeded and which failed. It
+// reports whether all of them succeeded.
+func printSummary(results []variants.Result) bool {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Config.OutputPath() < results[j].Config.OutputPath()
+	})
+	var failed int
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Fprintf(variants.Stdout, "FAIL %s: %v\n", r.Config.OutputPath(), r.Err)
+			printErrors(r)
+		} else {
+			fmt.Fprintf(variants.Stdout, "ok   %s\n", r.Config.OutputPath())
+		}
+	}
+	fmt.Fprintf(variants.Stdout, "%d succeeded, %d failed\n", len(results)-failed, failed)
+	return failed == 0
 }
 
-// mustRunCmd runs the cmd command and panics if the execution failed.
-func mustRunCmd(cmd *exec.Cmd) {
-	if b, err := cmd.CombinedOutput(); err != nil {
-		fmt.Fprintf(os.Stderr, "$ %s\n%s\n^^^\n", cmd, b)
-		panic(err)
+// maxSummaryErrors is how many errors of a failed build the summary lists.
+const maxSummaryErrors = 10
+
+// printErrors prints the errors of the failed build r, indented under its
+// entry in the summary, at most maxSummaryErrors of them and a pointer to the
+// log for the rest.
+func printErrors(r variants.Result) {
+	for i, e := range r.Errors {
+		if i == maxSummaryErrors {
+			fmt.Fprintf(variants.Stdout, "     ... %d more, see %s\n", len(r.Errors)-i, r.Config.LogPath())
+			break
+		}
+		fmt.Fprintf(variants.Stdout, "     %s\n", e)
+	}
+}
+
+// checkToolchains prints whether the toolchain of each of versions is
+// installed, and returns the versions that are missing.
+func checkToolchains(versions []string) (missing []string) {
+	for _, version := range versions {
+		installed, err := variants.GoVersion(version)
+		switch {
+		case err != nil:
+			fmt.Fprintf(variants.Stdout, "missing    %s: %v\n", version, err)
+			missing = append(missing, version)
+		case variants.IsToolchainPath(version), version == variants.Tip:
+			fmt.Fprintf(variants.Stdout, "installed  %s (%s)\n", version, installed)
+		case !variants.VersionMatches(version, installed):
+			fmt.Fprintf(variants.Stdout, "missing    %s: found %s\n", version, installed)
+			missing = append(missing, version)
+		default:
+			fmt.Fprintf(variants.Stdout, "installed  %s\n", version)
+		}
+	}
+	fmt.Fprintf(variants.Stdout, "%d installed, %d missing\n", len(versions)-len(missing), len(missing))
+	return missing
+}
+
+// printUpdates prints whether a newer patch release than each of versions
+// exists among releases, and whether a newer minor release than all of them
+// exists. Toolchain paths and tip are not checked. It returns the number of
+// updates found.
+func printUpdates(versions, releases []string) (updates int) {
+	newestListed := -1
+	for _, version := range versions {
+		if variants.IsToolchainPath(version) || version == variants.Tip {
+			continue
+		}
+		minor, err := variants.MinorVersion(version)
+		if err != nil {
+			fmt.Fprintf(variants.Stdout, "unknown    %s: %v\n", version, err)
+			continue
+		}
+		if minor > newestListed {
+			newestListed = minor
+		}
+		newest := version
+		for _, r := range releases {
+			if v, err := variants.MinorVersion(r); err == nil && v == minor && variants.PatchVersion(r) > variants.PatchVersion(newest) {
+				newest = r
+			}
+		}
+		if newest == version {
+			fmt.Fprintf(variants.Stdout, "current    %s\n", version)
+			continue
+		}
+		updates++
+		fmt.Fprintf(variants.Stdout, "outdated   %s: %s available\n", version, newest)
+	}
+	if newestListed >= 0 {
+		for _, r := range releases {
+			if v, err := variants.MinorVersion(r); err == nil && v > newestListed {
+				updates++
+				fmt.Fprintf(variants.Stdout, "newer      %s: newer than all listed versions\n", r)
+				break
+			}
+		}
 	}
+	fmt.Fprintf(variants.Stdout, "%d update(s) available\n", updates)
+	return updates
 }
@@ -0,0 +1,3 @@
+module github.com/rhcarvalho/go-build-variants
+
+go 1.21
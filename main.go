@@ -4,6 +4,12 @@ import "fmt"
 
 var info = "{}"
 
+var (
+	commit = ""
+	dirty  = ""
+)
+
 func main() {
 	fmt.Printf("Build info: %s\n", info)
+	fmt.Printf("Commit: %s (dirty: %s)\n", commit, dirty)
 }
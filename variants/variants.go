@@ -0,0 +1,3211 @@
+// Package variants builds variants of a Go program across a matrix of Go
+// versions, platforms and build options. The build.go command at the root of
+// the repository is its command line interface.
+package variants
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"debug/elf"
+	"debug/pe"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+// These variables configure all builds. Set them before building, and leave
+// them unchanged while builds run.
+var (
+	// Out is the directory where build outputs are written. Make it
+	// absolute for output paths to be absolute too.
+	Out = "dist"
+	// Timeout limits how long any single command, such as a build or a
+	// toolchain download, may run.
+	Timeout = 10 * time.Minute
+	// Retries is how many times toolchain installation steps, which depend
+	// on the network, are retried after failing.
+	Retries = 0
+	// OutputTemplate, if not nil, names outputs instead of the default naming
+	// scheme, see Config.OutputPath.
+	OutputTemplate *template.Template
+	// Layout is how outputs are arranged in Out: flat, or nested in
+	// GOOS/GOARCH subdirectories.
+	Layout = "flat"
+	// ContentAddressed stores outputs in Out/cas named after their digest,
+	// see storeCAS, and names them by symlinks in Out/refs instead.
+	ContentAddressed = false
+	// Stdout receives human-readable progress and reports. The command
+	// discards it when emitting JSON events, to keep the event stream clean.
+	Stdout io.Writer = os.Stdout
+	// Logger logs progress and warnings, to stderr unless the command is
+	// given -log-level or -log-format.
+	Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+)
+
+// Platform is a target operating system and architecture pair.
+type Platform struct {
+	GOOS   string
+	GOARCH string
+}
+
+// MatrixSpec describes the matrix of configurations to build. Each field lists
+// the values swept for one dimension of the matrix.
+type MatrixSpec struct {
+	// Go versions, in go1.x[.x] format, or paths to go commands such as
+	// /usr/local/go/bin/go, see IsToolchainPath.
+	Versions   []string
+	Platforms  []Platform
+	BuildModes []string // -buildmode values, the empty string builds the default, exe
+	GCFlags    []string // -gcflags values, the empty string builds with the default flags
+	AsmFlags   []string // -asmflags values, the empty string builds with the default flags
+	CGO        []bool   // CGO_ENABLED values
+	TrimPath   []bool
+	LinkModes  []string
+	Strip      []bool
+	Race       []bool
+	GOARM      []string // GOARM values, for arm targets
+	GOAMD64    []string // GOAMD64 values, for amd64 targets on go1.18 and later
+	PGO        []string // -pgo profiles, for go1.21 and later; the empty string builds without a profile
+	Overlays   []string // -overlay files, for go1.16 and later; the empty string builds without an overlay
+	// GOEXPERIMENT values, each skipped for Go versions that do not support
+	// it. The empty string builds without experiments.
+	Experiments []string
+	Kinds       []string // kinds of binaries to build, see Config.Kind
+	// Sanitizers to build with, msan or asan. The empty string builds without
+	// a sanitizer.
+	Sanitizers []string
+	Cover      []bool // whether to build with coverage instrumentation, for go1.20 and later
+	Static     []bool // whether to link statically, for linux targets with cgo and the external linker
+	FIPS       []bool // whether to build in FIPS 140 mode, see Config.FIPS
+	// Build tag sets, each a comma-separated list of tags. The empty string
+	// builds without tags.
+	Tags []string
+}
+
+// DefaultMatrix is the matrix built when no matrix file is given.
+var DefaultMatrix = MatrixSpec{
+	Versions: []string{
+		"go1.10.8",
+		"go1.11.13",
+		"go1.12.17",
+		"go1.13.8",
+		"go1.14",
+	},
+	Platforms: []Platform{
+		{"linux", "amd64"},
+		{"linux", "arm64"},
+		{"linux", "arm"},
+		{"darwin", "amd64"},
+		{"darwin", "arm64"},
+		{"windows", "amd64"},
+		{"js", "wasm"},
+		{"wasip1", "wasm"},
+	},
+	BuildModes: []string{"", "pie", "c-shared", "c-archive"},
+	GCFlags: []string{
+		"",
+		"all=-N -l", // disable optimizations and inlining
+	},
+	AsmFlags:    []string{""},
+	CGO:         []bool{false, true},
+	TrimPath:    []bool{false, true},
+	LinkModes:   []string{"internal", "external"},
+	Strip:       []bool{false, true},
+	Race:        []bool{false, true},
+	GOARM:       []string{"5", "6", "7"},
+	GOAMD64:     []string{"", "v3"}, // the empty string builds for the default level, v1
+	PGO:         []string{""},
+	Overlays:    []string{""},
+	Experiments: []string{""},
+	Kinds:       []string{""},
+	Sanitizers:  []string{""},
+	Cover:       []bool{false},
+	Static:      []bool{false},
+	FIPS:        []bool{false},
+	Tags:        []string{""},
+}
+
+// LoadMatrix reads a matrix from a JSON file with the same structure as
+// MatrixSpec. Dimensions missing from the file are swept as in DefaultMatrix.
+func LoadMatrix(path string) (MatrixSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return MatrixSpec{}, err
+	}
+	defer f.Close()
+	// Start from a deep copy of the default matrix, such that decoding the
+	// file does not overwrite the default slices.
+	var m MatrixSpec
+	b, err := json.Marshal(DefaultMatrix)
+	if err != nil {
+		return MatrixSpec{}, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return MatrixSpec{}, err
+	}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return MatrixSpec{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Expand returns the configurations in the matrix. The minor map gives the Go
+// minor version of each entry in m.Versions, used to skip platforms a
+// toolchain does not support and to sweep only the dimensions it supports.
+// Other combinations that cannot be built are left for Config.Validate to
+// reject. The Name, Package, GitCommit, GitDirty and BuildTime fields are left
+// for the caller to fill in.
+func (m *MatrixSpec) Expand(minor map[string]int) []Config {
+	var cfgs []Config
+	for _, version := range m.Versions {
+		v := minor[version]
+		for _, p := range m.Platforms {
+			if reason := platformUnsupported(p, v); reason != "" {
+				Logger.Info("skipping platform", "goversion", version, "platform", p.GOOS+"/"+p.GOARCH, "reason", reason)
+				continue
+			}
+			// Microarchitecture levels to build for, if they apply to the
+			// target architecture.
+			levels := []string{""}
+			switch {
+			case p.GOARCH == "arm":
+				levels = m.GOARM
+			case p.GOARCH == "amd64" && v >= 18:
+				// GOAMD64 was added in go1.18
+				levels = m.GOAMD64
+			}
+			for _, level := range levels {
+				for _, buildmode := range m.BuildModes {
+					for _, gcflags := range m.GCFlags {
+						for _, asmflags := range m.AsmFlags {
+							for _, cgo := range m.CGO {
+								for _, trimpath := range m.TrimPath {
+									for _, linkmode := range m.LinkModes {
+										for _, strip := range m.Strip {
+											for _, race := range m.Race {
+												for _, pgo := range m.PGO {
+													for _, overlay := range m.Overlays {
+														for _, experiment := range m.Experiments {
+															for _, kind := range m.Kinds {
+																for _, sanitizer := range m.Sanitizers {
+																	for _, cover := range m.Cover {
+																		for _, static := range m.Static {
+																			for _, fips := range m.FIPS {
+																				for _, tags := range m.Tags {
+																					cfg := Config{
+																						GoVersion:    version,
+																						GOOS:         p.GOOS,
+																						GOARCH:       p.GOARCH,
+																						CGOEnabled:   cgo,
+																						LinkMode:     linkmode,
+																						StripDebug:   strip,
+																						TrimPath:     trimpath,
+																						GCFlags:      gcflags,
+																						AsmFlags:     asmflags,
+																						BuildMode:    buildmode,
+																						Race:         race,
+																						PGOProfile:   pgo,
+																						Overlay:      overlay,
+																						GOExperiment: experiment,
+																						Kind:         kind,
+																						MSan:         sanitizer == "msan",
+																						ASan:         sanitizer == "asan",
+																						Cover:        cover,
+																						Static:       static,
+																						FIPS:         fips,
+																						Tags:         tags,
+																					}
+																					if trimpath && v >= 18 {
+																						// VCS stamping defeats the purpose of
+																						// -trimpath, reproducible outputs; -buildvcs
+																						// was added in go1.18
+																						cfg.BuildVCS = "false"
+																					}
+																					if p.GOARCH == "arm" {
+																						cfg.GOARM = level
+																					} else {
+																						cfg.GOAMD64 = level
+																					}
+																					cfgs = append(cfgs, cfg)
+																				}
+																			}
+																		}
+																	}
+																}
+															}
+														}
+													}
+												}
+											}
+										}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return cfgs
+}
+
+type Config struct {
+	Name    string
+	Package string // source file or package to build
+	// Dir is the directory to build in, such as that of another module, or
+	// empty for the current directory. Package is relative to it.
+	Dir       string `json:",omitempty"`
+	GoVersion string
+	// Toolchain is the path of the go command to build with, if not the
+	// command named GoVersion found in PATH.
+	Toolchain  string `json:",omitempty"`
+	GOOS       string
+	GOARCH     string
+	GOARM      string `json:",omitempty"`
+	GOAMD64    string `json:",omitempty"`
+	CGOEnabled bool
+	LinkMode   string
+	StripDebug bool
+	TrimPath   bool
+	GCFlags    string `json:",omitempty"`
+	AsmFlags   string `json:",omitempty"`
+	BuildMode  string `json:",omitempty"`
+	Race       bool   `json:",omitempty"`
+	MSan       bool   `json:",omitempty"` // build with -msan, using clang as the C compiler
+	ASan       bool   `json:",omitempty"`
+	// Cover builds with coverage instrumentation of CoverPkg, a comma-separated
+	// list of package patterns, or of the main module if empty. Covered
+	// binaries write coverage data to the GOCOVERDIR directory when they run.
+	Cover bool `json:",omitempty"`
+	// Static links the output statically, passing -static to the external
+	// linker.
+	Static bool `json:",omitempty"`
+	// FIPS builds in FIPS 140 mode, with GOFIPS140=latest for go1.24 and
+	// later, or else with GOEXPERIMENT=boringcrypto.
+	FIPS bool `json:",omitempty"`
+	// Tags is the comma-separated list of build tags to build with.
+	Tags       string `json:",omitempty"`
+	CoverPkg   string `json:",omitempty"`
+	PGOProfile string `json:",omitempty"`
+	// Overlay is the -overlay file replacing source files when building.
+	Overlay      string `json:",omitempty"`
+	GOExperiment string `json:",omitempty"`
+	// ModMode is the -mod value, one of vendor, readonly or mod, set with
+	// GOFLAGS for go1.11 and later, or empty for the default.
+	ModMode string `json:",omitempty"`
+	// BuildVCS is the value of -buildvcs, one of auto, true or false, or
+	// empty to not pass the flag, as for toolchains older than go1.18.
+	BuildVCS string `json:",omitempty"`
+	// Vars maps the fully qualified names of string variables, such as
+	// main.version, to values set with -X when linking.
+	Vars map[string]string `json:",omitempty"`
+	// WinRes is the file Windows resources were embedded from, see
+	// WriteWinRes.
+	WinRes string `json:",omitempty"`
+	// ExtraEnv holds environment variables set for the build command,
+	// overriding both inherited and generated ones, such as GOPROXY. Their
+	// values may hold credentials, so they are neither embedded in outputs
+	// nor recorded in the manifest, and those in unhashedEnv are not hashed.
+	ExtraEnv map[string]string `json:"-"`
+	// Kind is "test" to build the test binary of Package with go test -c, or
+	// empty to build Package with go build.
+	Kind string `json:",omitempty"`
+	// ExtraLDFlags are linker flags appended to the ones generated from the
+	// configuration, such as "-X main.version=1.0" or "-extldflags=-static".
+	ExtraLDFlags string `json:",omitempty"`
+	// NoInfo leaves out setting the main.info, main.commit and main.dirty
+	// variables describing the build when linking, for programs without
+	// them, unlike the bundled hello program.
+	NoInfo bool `json:",omitempty"`
+	// InjectGoVersion sets the main.goVersion variable to GoVersion when
+	// linking, for programs reporting it as a plain string.
+	InjectGoVersion bool `json:",omitempty"`
+	GitCommit       string
+	GitDirty        bool
+	BuildTime       time.Time
+}
+
+// Cmd returns a command that builds c, killed if ctx is done before it exits.
+func (c *Config) Cmd(ctx context.Context) *exec.Cmd {
+	return c.cmd(ctx, c.OutputPath())
+}
+
+// cmd returns a command that builds c writing the output to the given path.
+func (c *Config) cmd(ctx context.Context, output string) *exec.Cmd {
+	b, err := json.MarshalIndent(c.info(), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	// The linker does not support escaping quotes within quoted flags, so
+	// escape single quotes within the JSON itself.
+	b = bytes.Replace(b, []byte("'"), []byte(`\u0027`), -1)
+	ldflags := "-linkmode=" + c.LinkMode
+	if !c.NoInfo {
+		ldflags = fmt.Sprintf("-X 'main.info=%s' -X main.commit=%s -X main.dirty=%t %s",
+			b, c.GitCommit, c.GitDirty, ldflags)
+	}
+	if c.InjectGoVersion {
+		ldflags += " -X main.goVersion=" + c.GoVersion
+	}
+	var names []string
+	for name := range c.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ldflags += " -X " + ldflagQuote(name+"="+c.Vars[name])
+	}
+	if c.StripDebug {
+		ldflags += " -s -w"
+	}
+	if c.Static {
+		ldflags += " -extldflags=-static"
+	}
+	// Print the host link command, if any, see effectiveLinkMode.
+	ldflags += " -v"
+	if c.ExtraLDFlags != "" {
+		ldflags += " " + c.ExtraLDFlags
+	}
+	args := []string{"build"}
+	if c.Kind == "test" {
+		args = []string{"test", "-c"}
+	}
+	args = append(args,
+		"-o", output,
+		"-ldflags", ldflags,
+	)
+	if c.TrimPath {
+		args = append(args, "-trimpath")
+	}
+	if c.Tags != "" {
+		tags := c.Tags
+		if v, err := MinorVersion(c.GoVersion); err == nil && v < 13 {
+			// comma-separated tags were added in go1.13
+			tags = strings.Replace(tags, ",", " ", -1)
+		}
+		args = append(args, "-tags", tags)
+	}
+	if c.GCFlags != "" {
+		args = append(args, "-gcflags", c.GCFlags)
+	}
+	if c.AsmFlags != "" {
+		args = append(args, "-asmflags", c.AsmFlags)
+	}
+	if c.BuildMode != "" && c.BuildMode != "exe" && c.Kind != "test" {
+		args = append(args, "-buildmode="+c.BuildMode)
+	}
+	if c.Race {
+		args = append(args, "-race")
+	}
+	if c.MSan {
+		args = append(args, "-msan")
+	}
+	if c.ASan {
+		args = append(args, "-asan")
+	}
+	if c.Cover {
+		args = append(args, "-cover")
+		if c.CoverPkg != "" {
+			args = append(args, "-coverpkg="+c.CoverPkg)
+		}
+	}
+	if c.PGOProfile != "" {
+		args = append(args, "-pgo="+c.PGOProfile)
+	}
+	if c.Overlay != "" {
+		args = append(args, "-overlay="+c.Overlay)
+	}
+	if c.BuildVCS != "" {
+		args = append(args, "-buildvcs="+c.BuildVCS)
+	}
+	args = append(args, c.Package)
+	cmd := exec.CommandContext(ctx, c.goCommand(), args...)
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(), c.Env()...)
+	return cmd
+}
+
+// Reproducible reports whether building c is expected to be reproducible: it
+// builds with -trimpath, strips debug information and, for go1.18 and later,
+// does not stamp VCS information.
+func (c *Config) Reproducible() bool {
+	if !c.TrimPath || !c.StripDebug {
+		return false
+	}
+	if c.BuildVCS == "" {
+		v, err := MinorVersion(c.GoVersion)
+		return err == nil && v < 18
+	}
+	return c.BuildVCS == "false"
+}
+
+// goCommand returns the go command that builds c.
+func (c *Config) goCommand() string {
+	if c.Toolchain != "" {
+		return c.Toolchain
+	}
+	return c.GoVersion
+}
+
+// info returns the build information embedded in outputs as JSON: c, with the
+// build time formatted as an RFC 3339 UTC timestamp with second precision, or
+// omitted if it is zero. Where the toolchain and the sources are on the build
+// machine is left out, so that outputs do not depend on it.
+func (c *Config) info() interface{} {
+	// infoConfig has the fields of Config, but not its methods, so that
+	// embedding it does not make the info struct a Config.
+	type infoConfig Config
+	ic := infoConfig(*c)
+	ic.Toolchain = ""
+	ic.Dir = ""
+	info := struct {
+		*infoConfig
+		BuildTime string `json:",omitempty"` // shadows Config.BuildTime
+	}{infoConfig: &ic}
+	if !c.BuildTime.IsZero() {
+		info.BuildTime = c.BuildTime.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+// LogAttrs returns attributes identifying c in log records, so that records
+// of concurrent builds can be told apart.
+func (c *Config) LogAttrs() []interface{} {
+	attrs := []interface{}{
+		"output", c.OutputPath(),
+		"goversion", c.GoVersion,
+		"goos", c.GOOS,
+		"goarch", c.GOARCH,
+		"linkmode", c.LinkMode,
+	}
+	if c.ModMode != "" {
+		attrs = append(attrs, "mod", c.ModMode)
+	}
+	return attrs
+}
+
+// Env returns the environment variables that Cmd sets in addition to the
+// inherited environment.
+func (c *Config) Env() []string {
+	env := []string{
+		fmt.Sprintf("GOOS=%s", c.GOOS),
+		fmt.Sprintf("GOARCH=%s", c.GOARCH),
+	}
+	if c.GOARM != "" {
+		env = append(env, fmt.Sprintf("GOARM=%s", c.GOARM))
+	}
+	if c.GOAMD64 != "" {
+		env = append(env, fmt.Sprintf("GOAMD64=%s", c.GOAMD64))
+	}
+	if c.GOExperiment != "" {
+		env = append(env, fmt.Sprintf("GOEXPERIMENT=%s", c.GOExperiment))
+	}
+	if c.FIPS {
+		if v, err := MinorVersion(c.GoVersion); err == nil && v >= 24 {
+			env = append(env, "GOFIPS140=latest")
+		} else {
+			env = append(env, "GOEXPERIMENT=boringcrypto")
+		}
+	}
+	env = append(env, fmt.Sprintf("CGO_ENABLED=%s", boolToEnv(c.CGOEnabled)))
+	if c.ModMode != "" {
+		// Keep the flags the environment sets, such as -buildvcs=false.
+		flags := strings.TrimSpace(os.Getenv("GOFLAGS") + " -mod=" + c.ModMode)
+		env = append(env, "GOFLAGS="+flags)
+	}
+	if c.MSan {
+		// The memory sanitizer is only supported by clang.
+		env = append(env, "CC=clang")
+	}
+	var keys []string
+	for k := range c.ExtraEnv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+c.ExtraEnv[k])
+	}
+	return env
+}
+
+// CommandLine returns the command run by Cmd, including the directory it runs
+// in and the environment variables it sets, quoted such that it can be pasted
+// into a POSIX shell.
+func (c *Config) CommandLine() string {
+	var words []string
+	if c.Dir != "" {
+		words = append(words, "cd", shellQuote(c.Dir), "&&")
+	}
+	for _, kv := range c.Env() {
+		words = append(words, shellQuote(kv))
+	}
+	for _, arg := range c.Cmd(context.Background()).Args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// OutputPath returns the path of the output of building c. The file name
+// names every field that varies across the matrix, followed by a hash of the
+// whole configuration that tells apart configurations which differ only in
+// fields not shown, such as extra linker flags. If OutputTemplate is set, it is
+// executed with c to produce the file name instead. With the nested layout,
+// the file is in a GOOS/GOARCH subdirectory of Out.
+func (c *Config) OutputPath() string {
+	dir := Out
+	if ContentAddressed {
+		dir = filepath.Join(Out, "refs")
+	}
+	if Layout == "nested" {
+		dir = filepath.Join(dir, c.GOOS, c.GOARCH)
+	}
+	if OutputTemplate != nil {
+		var buf bytes.Buffer
+		if err := OutputTemplate.Execute(&buf, c); err != nil {
+			panic(err) // OutputTemplate must execute for any Config
+		}
+		return filepath.Join(dir, buf.String())
+	}
+	name := fmt.Sprintf("%s-%s-%s-%s", c.Name, c.GoVersion, c.GOOS, c.GOARCH)
+	if c.GOARM != "" {
+		name += "-goarm" + c.GOARM
+	}
+	if c.GOAMD64 != "" {
+		name += "-goamd64" + c.GOAMD64
+	}
+	if len(c.LinkMode) >= 3 {
+		name += "-" + c.LinkMode[:3] + "lnk"
+	}
+	if c.CGOEnabled {
+		name += "-cgo"
+	}
+	if c.StripDebug {
+		name += "-strip"
+	}
+	if c.TrimPath {
+		name += "-trimpath"
+	}
+	if c.GCFlags != "" {
+		name += "-gc" + alnum(c.GCFlags)
+	}
+	if c.AsmFlags != "" {
+		name += "-asm" + alnum(c.AsmFlags)
+	}
+	if c.BuildMode != "" && c.BuildMode != "exe" {
+		name += "-" + c.BuildMode
+	}
+	if c.Race {
+		name += "-race"
+	}
+	if c.MSan {
+		name += "-msan"
+	}
+	if c.ASan {
+		name += "-asan"
+	}
+	if c.Cover {
+		name += "-cover"
+	}
+	if c.Static {
+		name += "-static"
+	}
+	if c.FIPS {
+		name += "-fips"
+	}
+	if c.Tags != "" {
+		name += "-tags" + alnum(c.Tags)
+	}
+	if c.NoInfo {
+		name += "-noinfo"
+	}
+	if c.PGOProfile != "" {
+		name += "-pgo" + alnum(strings.TrimSuffix(filepath.Base(c.PGOProfile), filepath.Ext(c.PGOProfile)))
+	}
+	if c.Overlay != "" {
+		name += "-ovl" + alnum(strings.TrimSuffix(filepath.Base(c.Overlay), filepath.Ext(c.Overlay)))
+	}
+	if c.GOExperiment != "" {
+		name += "-exp" + alnum(c.GOExperiment)
+	}
+
+	// Append a hash of the config to the file name such that whenever the
+	// config changes we generate a new name, regardless of other parts of the
+	// file name.
+	name += "-" + c.Hash()
+
+	name += c.ext()
+	return filepath.Join(dir, name)
+}
+
+// Hash returns a hash of c. We ignore the c.BuildTime, otherwise every build
+// would have a different hash. The intention is that rebuilding the same
+// configuration overwrites an old output binary. For the same reason we ignore
+// the source revision. The hash is a truncated SHA-256 digest, long enough
+// that collisions are not a concern for any realistic matrix.
+func (c *Config) Hash() string {
+	snapshot := *c
+	snapshot.BuildTime = time.Time{}
+	snapshot.GitCommit = ""
+	snapshot.GitDirty = false
+	// The same Go version builds the same output wherever it is installed.
+	snapshot.Toolchain = ""
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		panic(err)
+	}
+	h := sha256.New()
+	h.Write(b)
+	var keys []string
+	for k := range c.ExtraEnv {
+		if !unhashedEnv[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "\x00%s=%s", k, c.ExtraEnv[k])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// unhashedEnv are the environment variables that change where the go command
+// caches or downloads things, but not what it builds. Leaving them out of the
+// hash keeps outputs named the same when, say, the build cache moves.
+var unhashedEnv = map[string]bool{
+	"GOCACHE":    true,
+	"GOMODCACHE": true,
+	"GOPROXY":    true,
+	"GONOPROXY":  true,
+	"GOSUMDB":    true,
+	"GONOSUMDB":  true,
+	"GOPRIVATE":  true,
+	"GOINSECURE": true,
+	"GOTMPDIR":   true,
+}
+
+// ParseOutputTemplate parses text as an output name template. Besides the
+// Config fields, templates may use the functions:
+//
+//	hash:  the hash of the configuration used by the default naming scheme
+//	ext:   the file name extension of the output, such as .exe
+//	alnum: the argument with only its letters and digits
+func ParseOutputTemplate(text string) (*template.Template, error) {
+	return template.New("output").Option("missingkey=error").Funcs(template.FuncMap{
+		"hash":  func(c *Config) string { return c.Hash() },
+		"ext":   func(c *Config) string { return c.ext() },
+		"alnum": alnum,
+	}).Parse(text)
+}
+
+// LogPath returns the path of the file where the output of building c is
+// logged. The logs directory mirrors the output directory, so that outputs
+// with the same file name in different directories, as with the nested
+// layout, have distinct logs.
+func (c *Config) LogPath() string {
+	rel, err := filepath.Rel(Out, c.OutputPath())
+	if err != nil {
+		panic(err) // outputs are always in Out
+	}
+	return filepath.Join(Out, "logs", rel+".log")
+}
+
+// ext returns the file name extension of the output, which depends on the
+// kind of binary, the target operating system and the build mode.
+func (c *Config) ext() string {
+	if c.GOARCH == "wasm" {
+		if c.Kind == "test" {
+			return ".test.wasm"
+		}
+		return ".wasm"
+	}
+	if c.Kind == "test" {
+		if c.GOOS == "windows" {
+			return ".test.exe"
+		}
+		return ".test"
+	}
+	switch c.BuildMode {
+	case "c-archive":
+		return ".a"
+	case "c-shared":
+		switch c.GOOS {
+		case "windows":
+			return ".dll"
+		case "darwin":
+			return ".dylib"
+		}
+		return ".so"
+	}
+	if c.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+// Validate returns an error if c cannot be built: because its toolchain does
+// not support its platform or features, or because they cannot be combined.
+func (c *Config) Validate() error {
+	v, err := MinorVersion(c.GoVersion)
+	if err != nil {
+		return err
+	}
+	native := runtime.GOOS == c.GOOS && runtime.GOARCH == c.GOARCH
+	buildmode := c.BuildMode
+	if buildmode == "" {
+		buildmode = "exe"
+	}
+	sanitizer := c.MSan || c.ASan
+	switch {
+	case c.LinkMode != "internal" && c.LinkMode != "external":
+		return fmt.Errorf("invalid link mode %q, want internal or external", c.LinkMode)
+	case platformUnsupported(Platform{c.GOOS, c.GOARCH}, v) != "":
+		return fmt.Errorf("%s/%s %s", c.GOOS, c.GOARCH, platformUnsupported(Platform{c.GOOS, c.GOARCH}, v))
+	case c.TrimPath && v < 13:
+		return errors.New("-trimpath was added in go1.13")
+	case c.Overlay != "" && v < 16:
+		return errors.New("-overlay was added in go1.16")
+	case c.PGOProfile != "" && v < 21:
+		return errors.New("-pgo was added in go1.21")
+	case !experimentSupported(c.GOExperiment, v):
+		return fmt.Errorf("GOEXPERIMENT=%s not supported", c.GOExperiment)
+	case c.Kind == "test" && buildmode != "exe":
+		return errors.New("test binaries are always executables")
+	case c.GOARCH == "wasm" && (c.CGOEnabled || c.StripDebug || buildmode != "exe"):
+		return errors.New("WebAssembly has no cgo, build modes other than exe nor symbols to strip")
+	case c.LinkMode == "external" && !c.CGOEnabled:
+		return errors.New("nothing to hand to the external linker without cgo")
+	case (buildmode == "c-shared" || buildmode == "c-archive") && (!c.CGOEnabled || c.LinkMode != "external"):
+		return errors.New("C libraries require cgo and the external linker")
+	case buildmode == "pie" && c.LinkMode == "internal" && !pieInternalLinking(c.GOOS, c.GOARCH, v):
+		return errors.New("platform requires external linking for PIE")
+	case c.LinkMode == "external" && !native:
+		return errors.New("cannot cross-compile using the external linker")
+	case c.Race && !c.CGOEnabled:
+		return errors.New("the race detector requires cgo")
+	case c.Race && (!raceSupported(c.GOOS, c.GOARCH, v) || !native):
+		return errors.New("race detector runtime not available for target")
+	case c.Cover && v < 20:
+		return errors.New("-cover was added for go build in go1.20")
+	case sanitizer && (!c.CGOEnabled || c.LinkMode != "external" || c.Race):
+		return errors.New("sanitizers require cgo and the external linker, and cannot be combined with the race detector")
+	case c.Static && (c.GOOS != "linux" || !c.CGOEnabled || c.LinkMode != "external" || sanitizer || buildmode != "exe"):
+		return errors.New("static linking requires linux, cgo and the external linker, and not sanitizers nor libraries")
+	case c.FIPS && (v < 19 || (v < 24 && (c.GOOS != "linux" || (c.GOARCH != "amd64" && c.GOARCH != "arm64") || !c.CGOEnabled || c.GOExperiment != ""))):
+		// before GOFIPS140 in go1.24, FIPS mode is the boringcrypto
+		// experiment of go1.19, which links BoringSSL with cgo on few
+		// targets
+		return errors.New("FIPS mode not available for target")
+	case c.MSan && (!SanitizerSupported("msan", c.GOOS, c.GOARCH, v) || !native),
+		c.ASan && (!SanitizerSupported("asan", c.GOOS, c.GOARCH, v) || !native):
+		return errors.New("sanitizer runtime not available for target")
+	}
+	return nil
+}
+
+// platformSupport lists the Go minor versions that added or removed ports,
+// by GOOS/GOARCH. Zero means the port is older than any version built, or
+// not removed.
+var platformSupport = []struct {
+	GOOS, GOARCH       string
+	addedIn, removedIn int
+}{
+	{"darwin", "386", 0, 15},
+	{"darwin", "arm", 0, 15},
+	{"darwin", "arm64", 16, 0},
+	{"freebsd", "riscv64", 20, 0},
+	{"illumos", "amd64", 13, 0},
+	{"ios", "amd64", 16, 0},
+	{"ios", "arm64", 16, 0},
+	{"js", "wasm", 11, 0},
+	{"linux", "loong64", 19, 0},
+	{"linux", "riscv64", 14, 0},
+	{"nacl", "386", 0, 14},
+	{"nacl", "amd64p32", 0, 14},
+	{"nacl", "arm", 0, 14},
+	{"openbsd", "arm64", 13, 0},
+	{"openbsd", "riscv64", 23, 0},
+	{"wasip1", "wasm", 21, 0},
+	{"windows", "arm", 12, 26},
+	{"windows", "arm64", 17, 0},
+}
+
+// platformUnsupported returns why Go minor version v cannot build for p, or
+// the empty string if it can, according to platformSupport.
+func platformUnsupported(p Platform, v int) string {
+	for _, s := range platformSupport {
+		if s.GOOS != p.GOOS || s.GOARCH != p.GOARCH {
+			continue
+		}
+		if s.addedIn != 0 && v < s.addedIn {
+			return fmt.Sprintf("added in go1.%d", s.addedIn)
+		}
+		if s.removedIn != 0 && v >= s.removedIn {
+			return fmt.Sprintf("removed in go1.%d", s.removedIn)
+		}
+	}
+	return ""
+}
+
+// pieInternalLinking reports whether the Go minor version v can link
+// -buildmode=pie executables for goos/goarch with the internal linker, as
+// listed by InternalLinkPIESupported in the internal/platform package of the
+// Go distribution. Other targets, such as linux/arm, need the external linker.
+func pieInternalLinking(goos, goarch string, v int) bool {
+	switch goos + "/" + goarch {
+	case "linux/amd64", "linux/arm64", "windows/386", "windows/amd64", "windows/arm", "windows/arm64":
+		return v >= 15
+	case "darwin/amd64", "darwin/arm64":
+		return v >= 16
+	case "android/arm64", "linux/ppc64le":
+		return v >= 20
+	case "linux/loong64":
+		return v >= 22
+	}
+	return false
+}
+
+// raceSupported reports whether the Go minor version v supports the race
+// detector for goos/goarch.
+func raceSupported(goos, goarch string, v int) bool {
+	switch goos + "/" + goarch {
+	case "linux/amd64", "darwin/amd64", "windows/amd64", "freebsd/amd64", "netbsd/amd64":
+		return true
+	case "linux/arm64":
+		return v >= 12
+	case "linux/ppc64le":
+		return v >= 10
+	case "darwin/arm64":
+		return v >= 16
+	}
+	return false
+}
+
+// CGOTags reports whether tags, a comma-separated list of build tags, only
+// has tags such as netgo that replace cgo implementations with pure Go ones,
+// and so make no difference when cgo is disabled.
+func CGOTags(tags string) bool {
+	if tags == "" {
+		return false
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag != "netgo" && tag != "osusergo" {
+			return false
+		}
+	}
+	return true
+}
+
+// SanitizerSupported reports whether the Go minor version v supports building
+// for goos/goarch with the sanitizer, msan or asan.
+func SanitizerSupported(sanitizer, goos, goarch string, v int) bool {
+	platform := goos + "/" + goarch
+	switch sanitizer {
+	case "msan":
+		switch platform {
+		case "linux/amd64":
+			return true
+		case "linux/arm64":
+			return v >= 11
+		case "freebsd/amd64":
+			return v >= 18
+		case "linux/loong64":
+			return v >= 21
+		}
+	case "asan":
+		if v < 18 {
+			// -asan was added in go1.18
+			return false
+		}
+		switch platform {
+		case "linux/amd64", "linux/arm64":
+			return true
+		case "linux/riscv64", "linux/ppc64le":
+			return v >= 19
+		case "linux/loong64":
+			return v >= 21
+		}
+	}
+	return false
+}
+
+// knownExperiments maps GOEXPERIMENT names to the Go minor version that added
+// them.
+var knownExperiments = map[string]int{
+	"regabi":          16,
+	"fieldtrack":      18,
+	"boringcrypto":    19,
+	"arenas":          20,
+	"cgocheck2":       21,
+	"loopvar":         21,
+	"rangefunc":       22,
+	"aliastypeparams": 23,
+	"swissmap":        24,
+	"synctest":        24,
+	"greenteagc":      25,
+	"jsonv2":          25,
+}
+
+// experimentSupported reports whether Go minor version v accepts the
+// GOEXPERIMENT value experiment, a comma-separated list of names that may be
+// negated with a "no" prefix. Names not in knownExperiments only require
+// go1.18, the first release to read GOEXPERIMENT at build time.
+func experimentSupported(experiment string, v int) bool {
+	if experiment == "" {
+		return true
+	}
+	if v < 18 {
+		return false
+	}
+	for _, name := range strings.Split(experiment, ",") {
+		added, ok := knownExperiments[name]
+		if !ok {
+			added = knownExperiments[strings.TrimPrefix(name, "no")]
+		}
+		if v < added {
+			return false
+		}
+	}
+	return true
+}
+
+// ldflagQuote quotes s as a single argument within -ldflags. The go command
+// splits -ldflags on spaces outside of quotes, and does not support escaping
+// quotes within quoted arguments, so s must not contain both single and
+// double quotes.
+func ldflagQuote(s string) string {
+	if !strings.Contains(s, "'") {
+		return "'" + s + "'"
+	}
+	return `"` + s + `"`
+}
+
+// alnum returns s with all characters other than ASCII letters and digits
+// removed, for use in file names.
+func alnum(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell.
+func shellQuote(s string) string {
+	safe := s != ""
+	for _, r := range s {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+./,:@%", r) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// boolToEnv formats b as a boolean environment variable value, "1" or "0".
+func boolToEnv(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// Manifest describes every artifact produced by a build run. It is safe for
+// concurrent use.
+type Manifest struct {
+	mu        sync.Mutex
+	Artifacts []Artifact
+	// Toolchains describes the environment of the toolchain of each Go
+	// version, see ToolchainEnvs.
+	Toolchains map[string]ToolchainEnv `json:",omitempty"`
+}
+
+// ToolchainEnv holds the go env settings of a toolchain which affect its
+// builds, empty if the toolchain does not report them.
+type ToolchainEnv struct {
+	GOROOT      string
+	GOVERSION   string `json:",omitempty"` // reported by go1.16 and later
+	CGO_ENABLED string // default, builds set it explicitly
+	CC          string
+}
+
+// ToolchainEnvs returns the environment of the toolchain of each Go version in
+// cfgs, running go env once per version.
+func ToolchainEnvs(ctx context.Context, cfgs []Config) (map[string]ToolchainEnv, error) {
+	envs := make(map[string]ToolchainEnv)
+	for _, cfg := range cfgs {
+		if _, ok := envs[cfg.GoVersion]; ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, Timeout)
+		b, err := exec.CommandContext(ctx, cfg.goCommand(), "env", "-json").Output()
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("%s env: %v", cfg.goCommand(), err)
+		}
+		var env ToolchainEnv
+		if err := json.Unmarshal(b, &env); err != nil {
+			return nil, fmt.Errorf("%s env: %v", cfg.goCommand(), err)
+		}
+		envs[cfg.GoVersion] = env
+	}
+	return envs, nil
+}
+
+// Artifact describes a single build output.
+type Artifact struct {
+	OutputPath string
+	GoVersion  string
+	Config     Config
+	// EffectiveLinkMode is the link mode actually used, which may differ from
+	// the requested Config.LinkMode. It is empty if it could not be detected.
+	EffectiveLinkMode string `json:",omitempty"`
+	// Compression is the method used to produce a compressed copy of the
+	// output, if any.
+	Compression string `json:",omitempty"`
+	// CompressionLevel is the upx compression level used, if not the
+	// default, and CompressedSize the size in bytes of the compressed copy.
+	CompressionLevel string `json:",omitempty"`
+	CompressedSize   int64  `json:",omitempty"`
+	// CodeSignIdentity is the identity the output was signed with by
+	// codesign, - for ad-hoc signing, if it was signed.
+	CodeSignIdentity string `json:",omitempty"`
+	// StaticallyLinked reports whether a linux executable output has no
+	// dynamic dependencies.
+	StaticallyLinked bool `json:",omitempty"`
+	// Digest is the SHA-256 digest naming the output in the
+	// content-addressable store, with -cas. OutputPath is then the symlink
+	// pointing to it.
+	Digest string `json:",omitempty"`
+}
+
+// Add records a in the manifest.
+func (m *Manifest) Add(a Artifact) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Artifacts = append(m.Artifacts, a)
+}
+
+// Write writes the manifest as JSON to path, with artifacts sorted by output
+// path so that runs over the same matrix produce stable diffs.
+func (m *Manifest) Write(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sort.Slice(m.Artifacts, func(i, j int) bool {
+		return m.Artifacts[i].OutputPath < m.Artifacts[j].OutputPath
+	})
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// Checksums collects SHA-256 digests of files. It is safe for concurrent use.
+type Checksums struct {
+	mu   sync.Mutex
+	sums map[string]string
+}
+
+// Add computes the SHA-256 digest of the file at path and records it.
+func (c *Checksums) Add(path string) error {
+	sum, err := sha256File(path)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sums == nil {
+		c.sums = make(map[string]string)
+	}
+	c.sums[path] = sum
+	return nil
+}
+
+// Write writes the recorded digests to path in the format understood by
+// sha256sum -c, sorted by file name. File names are relative to the directory
+// containing path.
+func (c *Checksums) Write(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := filepath.Dir(path)
+	sums := make(map[string]string, len(c.sums))
+	var names []string
+	for name, sum := range c.sums {
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		sums[rel] = sum
+		names = append(names, rel)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[name], name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Read records the digests in the file at path, as written by Write. A
+// missing or empty file records nothing.
+func (c *Checksums) Read(path string) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sums == nil {
+		c.sums = make(map[string]string)
+	}
+	dir := filepath.Dir(path)
+	for i, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			// Write leaves the file empty when there are no outputs,
+			// and ends it with a newline otherwise.
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			return fmt.Errorf("%s:%d: malformed line", path, i+1)
+		}
+		c.sums[filepath.Join(dir, filepath.FromSlash(name))] = sum
+	}
+	return nil
+}
+
+// Verify reports whether sum matches the digest recorded for path, or true if
+// none is recorded.
+func (c *Checksums) Verify(path, sum string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	want, ok := c.sums[path]
+	return !ok || sum == want
+}
+
+// Digests returns the recorded digests by path.
+func (c *Checksums) Digests() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sums := make(map[string]string, len(c.sums))
+	for path, sum := range c.sums {
+		sums[path] = sum
+	}
+	return sums
+}
+
+// Provenance records how the artifacts of a build run were produced, loosely
+// modeled on SLSA provenance.
+type Provenance struct {
+	Builder struct {
+		GOOS      string
+		GOARCH    string
+		GoVersion string // version of the Go runtime running the builds
+	}
+	Toolchains []string // Go versions that built the artifacts
+	GitCommit  string
+	GitDirty   bool
+	StartTime  time.Time
+	EndTime    time.Time
+	Artifacts  []ProvenanceArtifact
+}
+
+// ProvenanceArtifact is a file produced by a build run.
+type ProvenanceArtifact struct {
+	Path   string // relative to the output directory
+	SHA256 string
+}
+
+// WriteProvenance writes to path the provenance of a build run of commit that
+// started at start and ends now, recording the toolchains of the successful
+// results and the artifact digests sums, by path.
+func WriteProvenance(path string, start time.Time, commit string, dirty bool, results []Result, sums map[string]string) error {
+	var p Provenance
+	p.Builder.GOOS = runtime.GOOS
+	p.Builder.GOARCH = runtime.GOARCH
+	p.Builder.GoVersion = runtime.Version()
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if r.Err == nil && !seen[r.Config.GoVersion] {
+			seen[r.Config.GoVersion] = true
+			p.Toolchains = append(p.Toolchains, r.Config.GoVersion)
+		}
+	}
+	sort.Strings(p.Toolchains)
+	p.GitCommit, p.GitDirty = commit, dirty
+	p.StartTime, p.EndTime = start.UTC(), time.Now().UTC()
+	for name, sum := range sums {
+		rel, err := filepath.Rel(Out, name)
+		if err != nil {
+			return err
+		}
+		p.Artifacts = append(p.Artifacts, ProvenanceArtifact{Path: filepath.ToSlash(rel), SHA256: sum})
+	}
+	sort.Slice(p.Artifacts, func(i, j int) bool {
+		return p.Artifacts[i].Path < p.Artifacts[j].Path
+	})
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// Event is a build lifecycle event, emitted as a line of JSON with -json.
+type Event struct {
+	Time time.Time
+	// Action is one of start, build-started, build-cached, build-finished,
+	// build-failed, compress-finished or done.
+	Action  string
+	Output  string  `json:",omitempty"` // output path the event refers to
+	Total   int     `json:",omitempty"` // number of builds, for start events
+	Failed  int     `json:",omitempty"` // number of failed builds, for done events
+	Size    int64   `json:",omitempty"` // size of the output in bytes
+	Elapsed float64 `json:",omitempty"` // seconds spent building or compressing
+	Error   string  `json:",omitempty"`
+}
+
+// Events writes events as JSON lines. It is safe for concurrent use. The zero
+// value, like a nil *Events, discards events.
+type Events struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewEvents returns Events writing to w.
+func NewEvents(w io.Writer) *Events {
+	return &Events{enc: json.NewEncoder(w)}
+}
+
+// Emit writes e, setting its time to now.
+func (ev *Events) Emit(e Event) {
+	if ev == nil {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if ev.enc == nil {
+		return
+	}
+	e.Time = time.Now()
+	ev.enc.Encode(e)
+}
+
+// storeCAS moves the file at path into the content-addressable store in
+// Out/cas, named after its SHA-256 digest, and replaces it with a relative
+// symlink to the stored file. Identical outputs are stored once. A path that
+// is already a symlink, such as a cached output, is left as is. It returns the
+// digest.
+func storeCAS(path string) (string, error) {
+	if fi, err := os.Lstat(path); err != nil {
+		return "", err
+	} else if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Base(target), nil
+	}
+	sum, err := sha256File(path)
+	if err != nil {
+		return "", err
+	}
+	stored := filepath.Join(Out, "cas", sum)
+	if fileExists(stored) {
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(stored), 0755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(path, stored); err != nil {
+			return "", err
+		}
+	}
+	target, err := filepath.Rel(filepath.Dir(path), stored)
+	if err != nil {
+		return "", err
+	}
+	return sum, os.Symlink(target, path)
+}
+
+// unshareCAS replaces the symlink at path to a file in the content-addressable
+// store, see storeCAS, with a copy of the file, so that it can be modified
+// without modifying the stored file. A path that is not a symlink is left as
+// is.
+func unshareCAS(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if fi, err = os.Stat(path); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sha256File returns the hex-encoded SHA-256 digest of the file at path.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// GoVersion returns the version reported by the go command exe, such as
+// "go1.14", "go1.21rc2" or, for development toolchains, "go1.22-abcdef" or
+// "devel".
+func GoVersion(exe string) (string, error) {
+	b, err := exec.Command(exe, "version").Output()
+	if err != nil {
+		return "", err
+	}
+	// The output looks like one of:
+	//	go version go1.14 linux/amd64
+	//	go version devel go1.22-abcdef Tue Oct 3 10:00:00 2023 +0000 linux/amd64
+	//	go version devel +abcdef Tue Oct 3 10:00:00 2023 +0000 linux/amd64
+	f := strings.Fields(string(b))
+	if len(f) < 3 || f[0] != "go" || f[1] != "version" {
+		return "", fmt.Errorf("%s version: unexpected output %q", exe, b)
+	}
+	if f[2] != "devel" {
+		return f[2], nil
+	}
+	if len(f) > 3 && strings.HasPrefix(f[3], "go1") {
+		return f[3], nil
+	}
+	return "devel", nil
+}
+
+// DistList returns the platforms supported by the toolchain exe, as listed
+// by go tool dist list.
+func DistList(exe string) (map[Platform]bool, error) {
+	b, err := exec.Command(exe, "tool", "dist", "list").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s tool dist list: %v", exe, err)
+	}
+	supported := make(map[Platform]bool)
+	for _, line := range strings.Fields(string(b)) {
+		i := strings.Index(line, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("%s tool dist list: unexpected output %q", exe, line)
+		}
+		supported[Platform{GOOS: line[:i], GOARCH: line[i+1:]}] = true
+	}
+	return supported, nil
+}
+
+// IsToolchainPath reports whether a Go version in the matrix is the path of a
+// go command, such as /usr/local/go/bin/go, rather than the name of a
+// golang.org/dl wrapper command found in PATH, such as go1.14.
+func IsToolchainPath(version string) bool {
+	return strings.ContainsAny(version, `/\`)
+}
+
+// Tip is the golang.org/dl wrapper command of the development toolchain, built
+// from the tip of the Go repository. Its version changes with every download,
+// so outputs are named after the command instead, and version-gated features
+// treat it as newer than any release, see tipMinor.
+const Tip = "gotip"
+
+// tipMinor is the minor version number given to the development toolchain.
+const tipMinor = math.MaxInt32
+
+// VersionMatches reports whether the version reported by a go command is the
+// version named by exe. Besides being equal, the version may extend exe, such
+// that exe go1.22 matches the development version go1.22-abcdef, but not the
+// version go1.220. Any version matches tip.
+func VersionMatches(exe, version string) bool {
+	if exe == Tip {
+		return true
+	}
+	if !strings.HasPrefix(version, exe) {
+		return false
+	}
+	rest := version[len(exe):]
+	return rest == "" || rest[0] < '0' || rest[0] > '9'
+}
+
+// MinorVersion returns the minor version number of a Go version, such as 14
+// for go1.14.2, 21 for go1.21rc2 and 22 for go1.22-abcdef, or tipMinor for tip
+// and unnumbered development versions.
+func MinorVersion(version string) (int, error) {
+	if version == Tip || version == "devel" {
+		return tipMinor, nil
+	}
+	rest := strings.TrimPrefix(version, "go1.")
+	if rest == version {
+		return 0, fmt.Errorf("cannot parse Go version %q", version)
+	}
+	i := 0
+	for i < len(rest) && '0' <= rest[i] && rest[i] <= '9' {
+		i++
+	}
+	v, err := strconv.Atoi(rest[:i])
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse Go version %q", version)
+	}
+	return v, nil
+}
+
+// WriteWinRes writes resource object files embedding the Windows resources in
+// src into the directory of each of the package targets in buildDir, for each
+// windows platform, and returns their paths. The source is either a
+// comma-separated list of .syso files, one per windows GOARCH named like
+// rsrc_windows_amd64.syso, since resource object files are specific to an
+// architecture, or a versioninfo.json file compiled with goversioninfo. The
+// files are named such that the go command only links them into outputs for
+// windows/GOARCH, and must be removed when the builds finish.
+func WriteWinRes(src, buildDir string, targets []string, platforms []Platform) (generated []string, err error) {
+	var sysos map[string]string // .syso file by GOARCH
+	if filepath.Ext(src) == ".syso" {
+		sysos = make(map[string]string)
+		for _, path := range strings.Split(src, ",") {
+			i := strings.LastIndex(path, "_windows_")
+			if i < 0 || filepath.Ext(path) != ".syso" {
+				return nil, fmt.Errorf("%s: not named like rsrc_windows_GOARCH.syso", path)
+			}
+			sysos[strings.TrimSuffix(path[i+len("_windows_"):], ".syso")] = path
+		}
+		for _, p := range platforms {
+			if _, ok := sysos[p.GOARCH]; p.GOOS == "windows" && !ok {
+				return nil, fmt.Errorf("no .syso file for windows/%s, such as rsrc_windows_%s.syso", p.GOARCH, p.GOARCH)
+			}
+		}
+	}
+	for _, target := range targets {
+		dir := filepath.Join(buildDir, target)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return generated, fmt.Errorf("%s: not a package directory", target)
+		}
+		for _, p := range platforms {
+			if p.GOOS != "windows" {
+				continue
+			}
+			dst := filepath.Join(dir, "zz_winres_windows_"+p.GOARCH+".syso")
+			if sysos != nil {
+				b, err := os.ReadFile(sysos[p.GOARCH])
+				if err != nil {
+					return generated, err
+				}
+				if err := os.WriteFile(dst, b, 0644); err != nil {
+					return generated, err
+				}
+				generated = append(generated, dst)
+				continue
+			}
+			args := []string{"-o", dst}
+			switch p.GOARCH {
+			case "amd64":
+				args = append(args, "-64")
+			case "arm":
+				args = append(args, "-arm")
+			case "arm64":
+				args = append(args, "-arm", "-64")
+			}
+			generated = append(generated, dst)
+			if err := run(context.Background(), "goversioninfo", append(args, src)...); err != nil {
+				return generated, err
+			}
+		}
+	}
+	return generated, nil
+}
+
+// HashSources returns a digest of the Go source files in dir, the working
+// directory if empty, along with go.mod and go.sum files. Files in the output
+// directory and in hidden directories are ignored.
+func HashSources(dir string) (string, error) {
+	h := sha256.New()
+	if dir == "" {
+		dir = "."
+	}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if abs, err := filepath.Abs(path); err == nil && abs == Out {
+				return filepath.SkipDir
+			}
+			if path != dir && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if name := fi.Name(); !strings.HasSuffix(name, ".go") && name != "go.mod" && name != "go.sum" {
+			return nil
+		}
+		sum, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %s\n", sum, path)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheEntryPath returns the path of the cache entry recording the digest of
+// the output of c built from the sources with digest sources, see
+// HashSources. Since the hash of a configuration leaves the sources out, an
+// existing output may have been built from other sources, which the entry
+// tells apart.
+func cacheEntryPath(sources string, c *Config) string {
+	sum := sha256.Sum256([]byte(sources + " " + c.Hash()))
+	return filepath.Join(Out, ".cache", hex.EncodeToString(sum[:]))
+}
+
+// CacheHit reports whether the output of c exists and was built from sources,
+// as recorded by its cache entry.
+func CacheHit(sources string, c *Config) (bool, error) {
+	if !fileExists(c.OutputPath()) {
+		return false, nil
+	}
+	entry, err := os.ReadFile(cacheEntryPath(sources, c))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	sum, err := sha256File(c.OutputPath())
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(entry)) == sum, nil
+}
+
+// writeCacheEntry records the output of c as built from sources.
+func writeCacheEntry(sources string, c *Config) error {
+	sum, err := sha256File(c.OutputPath())
+	if err != nil {
+		return err
+	}
+	path := cacheEntryPath(sources, c)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(sum+"\n"), 0644)
+}
+
+// selectorAliases maps short selector keys to Config field names.
+var selectorAliases = map[string]string{
+	"version":    "GoVersion",
+	"cgo":        "CGOEnabled",
+	"strip":      "StripDebug",
+	"pgo":        "PGOProfile",
+	"experiment": "GOExperiment",
+	"src":        "Package",
+}
+
+// Selector selects configurations by the values of their fields. Keys are
+// Config field names, matched case-insensitively, or one of selectorAliases.
+// A configuration matches if, for every key, its field equals one of the
+// values.
+type Selector map[string][]string
+
+// ParseSelector parses a comma-separated list of key=value pairs, such as
+// goos=windows,goos=linux,linkmode=external. It returns a nil Selector for an
+// empty string.
+func ParseSelector(s string) (Selector, error) {
+	if s == "" {
+		return nil, nil
+	}
+	sel := make(Selector)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not in key=value format", pair)
+		}
+		key := strings.ToLower(kv[0])
+		if alias, ok := selectorAliases[key]; ok {
+			key = strings.ToLower(alias)
+		}
+		if _, ok := configField(key); !ok {
+			return nil, fmt.Errorf("unknown key %q", kv[0])
+		}
+		sel[key] = append(sel[key], kv[1])
+	}
+	return sel, nil
+}
+
+// configField returns the Config field named key, ignoring case.
+func configField(key string) (reflect.StructField, bool) {
+	return reflect.TypeOf(Config{}).FieldByNameFunc(func(name string) bool {
+		return strings.ToLower(name) == key
+	})
+}
+
+// Matches reports whether c is selected by s.
+func (s Selector) Matches(c *Config) bool {
+	v := reflect.ValueOf(c).Elem()
+	for key, values := range s {
+		f, _ := configField(key)
+		got := fmt.Sprint(v.FieldByIndex(f.Index).Interface())
+		found := false
+		for _, want := range values {
+			if got == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Progress is notified as builds finish, such as to draw a progress bar.
+type Progress interface {
+	Start(total int) // builds of total configurations are starting
+	Finished()       // one more build finished
+	Clear()          // all builds finished
+}
+
+// Builder builds configurations and records the artifacts they produce. The
+// zero value builds outputs without compressing them, and discards events.
+type Builder struct {
+	Compression string // compression method, see compress, or empty for none
+	UPXLevel    string // upx compression level, see UPXOption, or empty for the default
+	Cache       bool   // whether to skip outputs that already exist
+	Verify      bool   // whether to verify reproducibility instead of building outputs
+	SBOM        bool   // whether to write an SBOM for each output, see writeSBOM
+	Warnings    string // how to handle build warnings: show, the default, error or ignore
+	// MaxSize is the size in bytes above which outputs fail the build, or
+	// zero for no limit. If MaxSizeCompressed, the size of compressed
+	// outputs is checked instead.
+	MaxSize           int64
+	MaxSizeCompressed bool
+	MaxFailures       int  // number of failed builds after which to stop, or zero for no limit
+	Rebuild           bool // whether to rebuild packages found in the build cache, for timing builds
+	NoOutput          bool // whether to discard outputs, only checking that configurations build
+	// PostBuild, if not nil, renders a shell command run for each successful
+	// output. Unless PostBuildWarn, its failure fails the build.
+	PostBuild     *template.Template
+	PostBuildWarn bool
+	CodeSign      string   // identity to sign darwin outputs with, if any
+	Events        *Events  // nil to discard events
+	Progress      Progress // nil to not show progress
+	Manifest      Manifest
+	Checksums     Checksums
+	Cached        Checksums // digests of the outputs of a prior run, to verify cached outputs
+	Sources       string    // digest of the sources, see HashSources, to key cached outputs
+}
+
+// Result is the outcome of building a single configuration.
+type Result struct {
+	Config     Config
+	OutputPath string // path of the output, see Config.OutputPath
+	Err        error
+	Duration   time.Duration // time spent running the build command
+	LinkMode   string        // effective link mode, see effectiveLinkMode
+	Size       int64         // size of the output in bytes
+	Cached     bool          // whether the output of a prior run was reused
+	// CompressedSize is the size of the compressed output in bytes, if any.
+	CompressedSize int64
+	// CodeSignIdentity is the identity the output was signed with, if any.
+	CodeSignIdentity string
+	StaticallyLinked bool   // whether the output has no dynamic dependencies, see staticallyLinked
+	Digest           string // digest of the output in the content-addressable store, see storeCAS
+	// Digests are the SHA-256 digests of the two outputs built when verifying
+	// reproducibility.
+	Digests []string
+	// Errors are the distinct errors printed by a failed build, see
+	// buildErrors.
+	Errors []BuildError
+}
+
+// errTooManyFailures is the cause of canceling builds once too many of them
+// failed.
+var errTooManyFailures = errors.New("too many failures")
+
+// BuildAll builds cfgs running up to jobs builds in parallel, or all of them
+// at once if jobs is not positive, and returns the result of each build in the
+// order they finished. The error is not nil only if ctx is done before all
+// builds finish, in which case no more builds are started and the results are
+// incomplete. Failed builds are reported in the results. Once b.MaxFailures
+// builds fail, the remaining builds are canceled and left out of the results.
+func (b *Builder) BuildAll(ctx context.Context, cfgs []Config, jobs int) ([]Result, error) {
+	buildCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	results := make(chan Result)
+	var summary []Result
+	done := make(chan struct{})
+	go func() {
+		var failed int
+		for r := range results {
+			summary = append(summary, r)
+			if r.Err != nil {
+				failed++
+				if failed == b.MaxFailures {
+					cancel(errTooManyFailures)
+				}
+			}
+		}
+		close(done)
+	}()
+
+	// The drain loop below relies on sem having a capacity of at least one.
+	n := jobs
+	if n <= 0 || n > len(cfgs) {
+		n = len(cfgs)
+	}
+	if n == 0 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	b.Events.Emit(Event{Action: "start", Total: len(cfgs)})
+	if b.Progress != nil {
+		b.Progress.Start(len(cfgs))
+		defer b.Progress.Clear()
+	}
+	for _, cfg := range cfgs {
+		sem <- struct{}{}
+		if buildCtx.Err() != nil {
+			// interrupted, stop launching builds
+			<-sem
+			break
+		}
+		cfg := cfg
+		go func() {
+			r := Result{Config: cfg, OutputPath: cfg.OutputPath()}
+			r.Err = b.build(buildCtx, &r)
+			if r.Err != nil && context.Cause(buildCtx) == errTooManyFailures {
+				// canceled, not failed on its own
+				<-sem
+				return
+			}
+			if r.Err != nil {
+				b.Events.Emit(Event{Action: "build-failed", Output: cfg.OutputPath(), Error: r.Err.Error()})
+			} else {
+				b.Events.Emit(Event{Action: "build-finished", Output: cfg.OutputPath(), Size: r.Size, Elapsed: r.Duration.Seconds()})
+			}
+			if b.Progress != nil {
+				b.Progress.Finished()
+			}
+			results <- r
+			<-sem
+		}()
+	}
+	for n := cap(sem); n > 0; n-- {
+		sem <- struct{}{}
+	}
+	close(results)
+	<-done
+	if err := ctx.Err(); err != nil {
+		return summary, err
+	}
+	if context.Cause(buildCtx) == errTooManyFailures {
+		Logger.Error("too many builds failed, stopped building", "failed", b.MaxFailures, "skipped", len(cfgs)-len(summary))
+	}
+	var failed int
+	for _, r := range summary {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	b.Events.Emit(Event{Action: "done", Total: len(summary), Failed: failed})
+	return summary, nil
+}
+
+// BuildAll builds cfgs like Builder.BuildAll with the zero Builder.
+func BuildAll(ctx context.Context, cfgs []Config, jobs int) ([]Result, error) {
+	return new(Builder).BuildAll(ctx, cfgs, jobs)
+}
+
+// build builds r.Config and records its artifacts, filling in r with the
+// outcome. With caching enabled, outputs that already exist are not rebuilt
+// unless their cache entry shows they were built from other sources. Because
+// the output path embeds a hash of the configuration, an existing output means
+// the configuration is unchanged.
+func (b *Builder) build(ctx context.Context, r *Result) error {
+	cfg := r.Config
+	logger := Logger.With(cfg.LogAttrs()...)
+	if b.Verify {
+		return b.verifyReproducible(ctx, r)
+	}
+	cached := b.Cache && fileExists(cfg.OutputPath())
+	if cached {
+		sum, err := sha256File(cfg.OutputPath())
+		if err != nil {
+			return err
+		}
+		entry, err := os.ReadFile(cacheEntryPath(b.Sources, &cfg))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		switch {
+		case !b.Cached.Verify(cfg.OutputPath(), sum):
+			logger.Warn("cache corrupt, rebuilding")
+			cached = false
+		case strings.TrimSpace(string(entry)) != sum:
+			logger.Info("output not built from the current sources, rebuilding")
+			cached = false
+		}
+	}
+	r.Cached = cached
+	if cached {
+		logger.Info("cached")
+		b.Events.Emit(Event{Action: "build-cached", Output: cfg.OutputPath()})
+	} else {
+		logger.Info("building")
+		b.Events.Emit(Event{Action: "build-started", Output: cfg.OutputPath()})
+		if ContentAddressed && !b.NoOutput {
+			// The go command writes through an existing symlink,
+			// which would overwrite a stored output other refs may
+			// point to.
+			os.Remove(cfg.OutputPath())
+		}
+		start := time.Now()
+		cmd := cfg.Cmd(ctx)
+		if b.NoOutput {
+			output := os.DevNull
+			if cfg.BuildMode == "c-archive" || cfg.BuildMode == "c-shared" {
+				// The C header written next to libraries cannot go to the
+				// null device.
+				dir, err := os.MkdirTemp("", "build-variants-")
+				if err != nil {
+					return err
+				}
+				defer os.RemoveAll(dir)
+				output = filepath.Join(dir, filepath.Base(cfg.OutputPath()))
+			}
+			cmd = cfg.cmd(ctx, output)
+		}
+		if b.Rebuild {
+			cmd.Args = append(cmd.Args[:2], append([]string{"-a"}, cmd.Args[2:]...)...)
+		}
+		err := runCmdLog(ctx, cmd, cfg.LogPath())
+		r.Duration = time.Since(start)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Do not leave truncated outputs behind. Without
+				// outputs, the path may hold one of an earlier run.
+				if !b.NoOutput {
+					os.Remove(cfg.OutputPath())
+				}
+				return err
+			}
+			if errs, logErr := buildErrors(cfg.LogPath()); logErr == nil {
+				r.Errors = errs
+			}
+			return err
+		}
+		if b.Warnings != "ignore" {
+			lines, err := buildWarnings(cfg.LogPath())
+			if err != nil {
+				return err
+			}
+			for _, line := range lines {
+				logger.Warn("build warning", "line", line)
+			}
+			if len(lines) > 0 && b.Warnings == "error" {
+				return fmt.Errorf("build printed %d warning(s), see %s", len(lines), cfg.LogPath())
+			}
+		}
+	}
+	if b.NoOutput {
+		return nil
+	}
+	if ContentAddressed && (b.CodeSign != "" || b.PostBuild != nil) {
+		// Signing and post-build commands modify the output in place,
+		// which must not change a stored output other refs may point
+		// to. The modified output is stored anew below.
+		if err := unshareCAS(cfg.OutputPath()); err != nil {
+			return fmt.Errorf("copying stored output: %v", err)
+		}
+	}
+	if b.CodeSign != "" && cfg.GOOS == "darwin" && cfg.BuildMode != "c-archive" {
+		if runtime.GOOS != "darwin" {
+			logger.Warn("codesign is only available on macOS, leaving the output unsigned", "host", runtime.GOOS)
+		} else {
+			if err := run(ctx, "codesign", "--force", "--sign", b.CodeSign, cfg.OutputPath()); err != nil {
+				return fmt.Errorf("codesign: %v", err)
+			}
+			r.CodeSignIdentity = b.CodeSign
+		}
+	}
+	if !cached || r.CodeSignIdentity != "" {
+		// Signing changes the output, even a cached one, so the entry
+		// records it signed.
+		if err := writeCacheEntry(b.Sources, &cfg); err != nil {
+			return fmt.Errorf("writing cache entry: %v", err)
+		}
+	}
+	if err := b.Checksums.Add(cfg.OutputPath()); err != nil {
+		return err
+	}
+	fi, err := os.Stat(cfg.OutputPath())
+	if err != nil {
+		return err
+	}
+	r.Size = fi.Size()
+	if cfg.BuildMode != "c-archive" { // archives are not linked
+		if mode, err := effectiveLinkMode(cfg.LogPath()); err == nil {
+			r.LinkMode = mode
+			if mode != cfg.LinkMode {
+				logger.Warn("link mode differs from the requested one", "effective", mode)
+			}
+		}
+	}
+	if cfg.WinRes != "" && cfg.BuildMode != "c-archive" {
+		ok, err := hasResources(cfg.OutputPath())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s has no Windows resources embedded from %s", cfg.OutputPath(), cfg.WinRes)
+		}
+	}
+	if cfg.GOOS == "linux" && cfg.BuildMode != "c-archive" && cfg.BuildMode != "c-shared" {
+		static, err := staticallyLinked(cfg.OutputPath())
+		if err != nil {
+			return err
+		}
+		if cfg.Static && !static {
+			return fmt.Errorf("%s is dynamically linked", cfg.OutputPath())
+		}
+		r.StaticallyLinked = static
+	}
+	if cfg.FIPS && cfg.BuildMode != "c-archive" && cfg.GOARCH != "wasm" {
+		if err := verifyFIPS(ctx, &cfg); err != nil {
+			return err
+		}
+	}
+	if b.SBOM && cfg.BuildMode != "c-archive" { // archives have no build info
+		sbomPath := cfg.OutputPath() + ".sbom.json"
+		if err := writeSBOM(sbomPath, cfg.OutputPath()); err != nil {
+			return fmt.Errorf("writing SBOM: %v", err)
+		}
+		if err := b.Checksums.Add(sbomPath); err != nil {
+			return err
+		}
+	}
+	method := b.Compression
+	if method == "" || (method == "upx" && !upxSupported(&cfg)) {
+		method = "none"
+	}
+	if method != "none" {
+		// The build succeeded, so a compression failure only loses the
+		// compressed copy.
+		if err := b.compress(ctx, r, method); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			logger.Warn("compression failed, keeping only the uncompressed output", "method", method, "err", err)
+			method = "none"
+		}
+	}
+	if b.PostBuild != nil {
+		hook := PostBuild{Path: cfg.OutputPath(), Config: cfg}
+		if method != "none" {
+			hook.CompressedPath = compressedPath(cfg.OutputPath(), method, b.UPXLevel)
+		}
+		if err := b.runPostBuild(ctx, hook); err != nil {
+			if !b.PostBuildWarn || ctx.Err() != nil {
+				return fmt.Errorf("post-build command: %v", err)
+			}
+			logger.Warn("post-build command failed", "err", err)
+		}
+		// The command may have modified the outputs, such as by signing them.
+		for _, path := range []string{hook.Path, hook.CompressedPath} {
+			if path == "" {
+				continue
+			}
+			if err := b.Checksums.Add(path); err != nil {
+				return err
+			}
+		}
+	}
+	if ContentAddressed {
+		// Stored last, once nothing modifies the output anymore.
+		digest, err := storeCAS(cfg.OutputPath())
+		if err != nil {
+			return fmt.Errorf("storing output: %v", err)
+		}
+		r.Digest = digest
+	}
+	if b.MaxSize > 0 {
+		size, what := r.Size, "output"
+		if b.MaxSizeCompressed && method != "none" {
+			size, what = r.CompressedSize, "compressed output"
+		}
+		if size > b.MaxSize {
+			return fmt.Errorf("%s is %d bytes, larger than -max-size of %d bytes", what, size, b.MaxSize)
+		}
+	}
+	artifact := Artifact{
+		OutputPath:        cfg.OutputPath(),
+		GoVersion:         cfg.GoVersion,
+		Config:            cfg,
+		EffectiveLinkMode: r.LinkMode,
+		CodeSignIdentity:  r.CodeSignIdentity,
+		StaticallyLinked:  r.StaticallyLinked,
+		Digest:            r.Digest,
+	}
+	if method != "none" {
+		artifact.Compression = method
+		artifact.CompressedSize = r.CompressedSize
+		if method == "upx" {
+			artifact.CompressionLevel = b.UPXLevel
+		}
+	}
+	b.Manifest.Add(artifact)
+	return nil
+}
+
+// compress compresses the output of r.Config with method and records the
+// compressed copy in r. On failure, it removes any partially written copy.
+func (b *Builder) compress(ctx context.Context, r *Result, method string) error {
+	cfg := r.Config
+	logger := Logger.With(cfg.LogAttrs()...)
+	compressed := compressedPath(cfg.OutputPath(), method, b.UPXLevel)
+	var elapsed time.Duration
+	if r.Cached && fileExists(compressed) {
+		logger.Info("cached", "compressed", compressed)
+	} else {
+		logger.Info("compressing", "compressed", compressed)
+		start := time.Now()
+		if err := compress(ctx, cfg.OutputPath(), method, b.UPXLevel); err != nil {
+			os.Remove(compressed)
+			return err
+		}
+		elapsed = time.Since(start)
+	}
+	fi, err := os.Stat(compressed)
+	if err != nil {
+		return err
+	}
+	if err := b.Checksums.Add(compressed); err != nil {
+		return err
+	}
+	r.CompressedSize = fi.Size()
+	b.Events.Emit(Event{Action: "compress-finished", Output: compressed, Size: r.CompressedSize, Elapsed: elapsed.Seconds()})
+	return nil
+}
+
+// PostBuild is the data available to -post-build command templates.
+type PostBuild struct {
+	Path           string // path of the output
+	CompressedPath string // path of the compressed output, if any
+	Config         Config
+}
+
+// runPostBuild runs the post-build command rendered for hook with the shell.
+func (b *Builder) runPostBuild(ctx context.Context, hook PostBuild) error {
+	var buf bytes.Buffer
+	if err := b.PostBuild.Execute(&buf, hook); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return run(ctx, "cmd", "/C", buf.String())
+	}
+	return run(ctx, "sh", "-c", buf.String())
+}
+
+// upxSupported reports whether upx can compress the output of c. Besides
+// archives, which are not executables, upx does not support shared
+// libraries built by Go, Mach-O executables for recent macOS versions,
+// Windows on ARM nor WebAssembly. Covered binaries are not compressed either.
+func upxSupported(c *Config) bool {
+	switch {
+	case c.BuildMode == "c-archive", c.BuildMode == "c-shared":
+		return false
+	case c.GOOS == "darwin":
+		return false
+	case c.GOOS == "windows" && c.GOARCH == "arm64":
+		return false
+	case c.GOARCH == "wasm":
+		return false
+	case c.Cover:
+		// Covered binaries are meant for testing, not distribution.
+		return false
+	}
+	return true
+}
+
+// Module is a Go module a binary was built from, as reported by go version -m.
+type Module struct {
+	Path    string
+	Version string
+}
+
+// buildModules returns the main module and the dependencies of the binary at
+// path. It uses the go command running this program rather than the toolchain
+// that built the binary, since go version -m was added in go1.13 and can read
+// binaries built by older toolchains. Binaries built outside of module mode
+// have no main module nor dependencies.
+func buildModules(path string) (mainMod Module, deps []Module, err error) {
+	b, err := exec.Command("go", "version", "-m", path).Output()
+	if err != nil {
+		return Module{}, nil, fmt.Errorf("go version -m %s: %v", path, err)
+	}
+	// The output looks like:
+	//	dist/hello: go1.14
+	//		path	example.com/hello
+	//		mod	example.com/hello	(devel)
+	//		dep	golang.org/x/sys	v0.1.0	h1:...
+	//		=>	golang.org/x/sys	v0.2.0	h1:...
+	// where => replaces the dependency on the line above.
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Split(strings.TrimPrefix(line, "\t"), "\t")
+		if len(f) < 3 {
+			continue
+		}
+		m := Module{Path: f[1], Version: f[2]}
+		switch f[0] {
+		case "mod":
+			mainMod = m
+		case "dep":
+			deps = append(deps, m)
+		case "=>":
+			if len(deps) > 0 {
+				deps[len(deps)-1] = m
+			}
+		}
+	}
+	return mainMod, deps, nil
+}
+
+// cycloneDXComponent is a component in a CycloneDX SBOM.
+type cycloneDXComponent struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+// writeSBOM writes a minimal CycloneDX SBOM listing the modules the binary at
+// exe was built from to path.
+func writeSBOM(path, exe string) error {
+	mainMod, deps, err := buildModules(exe)
+	if err != nil {
+		return err
+	}
+	component := func(typ string, m Module) cycloneDXComponent {
+		c := cycloneDXComponent{Type: typ, Name: m.Path, Version: m.Version}
+		if m.Version != "" && m.Version != "(devel)" {
+			c.PURL = "pkg:golang/" + m.Path + "@" + m.Version
+		}
+		return c
+	}
+	app := component("application", mainMod)
+	if app.Name == "" {
+		app.Name = filepath.Base(exe)
+	}
+	bom := struct {
+		BOMFormat   string `json:"bomFormat"`
+		SpecVersion string `json:"specVersion"`
+		Version     int    `json:"version"`
+		Metadata    struct {
+			Component cycloneDXComponent `json:"component"`
+		} `json:"metadata"`
+		Components []cycloneDXComponent `json:"components"`
+	}{BOMFormat: "CycloneDX", SpecVersion: "1.4", Version: 1}
+	bom.Metadata.Component = app
+	bom.Components = []cycloneDXComponent{}
+	for _, m := range deps {
+		bom.Components = append(bom.Components, component("library", m))
+	}
+	b, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// verifyFIPS checks that the output of cfg was built in FIPS 140 mode. With
+// GOFIPS140, the mode is recorded in the build information, while with
+// boringcrypto the output must link the BoringCrypto marker symbol, which
+// programs not using crypto packages lack.
+func verifyFIPS(ctx context.Context, cfg *Config) error {
+	if v, err := MinorVersion(cfg.GoVersion); err == nil && v >= 24 {
+		info, err := buildinfo.ReadFile(cfg.OutputPath())
+		if err != nil {
+			return err
+		}
+		for _, s := range info.Settings {
+			if s.Key == "GOFIPS140" && s.Value != "off" {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: GOFIPS140 not set in build information", cfg.OutputPath())
+	}
+	cmd := exec.CommandContext(ctx, cfg.goCommand(), "tool", "nm", cfg.OutputPath())
+	b, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go tool nm: %v", err)
+	}
+	if !bytes.Contains(b, []byte("crypto/internal/boring/sig.BoringCrypto")) {
+		return fmt.Errorf("%s does not link BoringCrypto", cfg.OutputPath())
+	}
+	return nil
+}
+
+// hasResources reports whether the PE file at path has a resource section,
+// where the linker puts the resources of .syso files.
+func hasResources(path string) (bool, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return f.Section(".rsrc") != nil, nil
+}
+
+// staticallyLinked reports whether the ELF executable at path has neither a
+// dynamic loader nor shared library dependencies.
+func staticallyLinked(path string) (bool, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return false, nil
+		}
+	}
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return false, err
+	}
+	return len(libs) == 0, nil
+}
+
+// effectiveLinkMode returns the link mode actually used by a build, based on
+// its log file. The linker may fall back to external linking, such as when
+// linking cgo packages outside of the standard library, even if internal
+// linking was requested. Run with -ldflags=-v, the linker logs the command it
+// uses to invoke the external linker.
+func effectiveLinkMode(logPath string) (string, error) {
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Contains(b, []byte("host link:")) {
+		return "external", nil
+	}
+	return "internal", nil
+}
+
+// buildWarnings returns the warnings printed by a successful build, based on
+// its log file. Because builds run the linker in verbose mode, see
+// effectiveLinkMode, output alone does not indicate a problem; instead, the
+// lines reported are those mentioning a warning, as printed by the compilers
+// and the external linker.
+func buildWarnings(logPath string) ([]string, error) {
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.Contains(strings.ToLower(line), "warning:") {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	return lines, nil
+}
+
+// BuildError is an error printed by the compiler, the assembler or the linker.
+type BuildError struct {
+	File    string `json:",omitempty"` // empty for errors not about a source file
+	Line    int    `json:",omitempty"`
+	Column  int    `json:",omitempty"`
+	Message string
+}
+
+func (e BuildError) String() string {
+	switch {
+	case e.File == "":
+		return e.Message
+	case e.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+var (
+	// sourceErrorRE matches errors about a source file, such as
+	// "./main.go:12:2: undefined: foo".
+	sourceErrorRE = regexp.MustCompile(`^(\S+\.(?:go|s|c|h|cc|cpp|m)):(\d+)(?::(\d+))?: (.+)$`)
+	// linkErrorRE matches errors of the linker and of the external linker
+	// it runs, such as "/usr/lib/go/pkg/tool/linux_amd64/link: running gcc
+	// failed: exit status 1" or "main.main: relocation target foo not
+	// defined".
+	linkErrorRE = regexp.MustCompile(`^(?:\S*/link: |\S+: relocation target |/usr/bin/ld: |collect2: )`)
+)
+
+// buildErrors returns the distinct errors printed by a failed build, in order,
+// based on its log file. Other lines, such as the package headers printed by
+// the go command and the verbose output of the linker, are left out.
+func buildErrors(logPath string) ([]BuildError, error) {
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		return nil, err
+	}
+	var errs []BuildError
+	seen := make(map[BuildError]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		var e BuildError
+		if m := sourceErrorRE.FindStringSubmatch(line); m != nil {
+			e.File = m[1]
+			e.Line, _ = strconv.Atoi(m[2])
+			e.Column, _ = strconv.Atoi(m[3])
+			e.Message = m[4]
+		} else if linkErrorRE.MatchString(line) {
+			e.Message = line
+		} else {
+			continue
+		}
+		if !seen[e] {
+			seen[e] = true
+			errs = append(errs, e)
+		}
+	}
+	return errs, nil
+}
+
+// verifyReproducible builds r.Config twice into temporary files and records
+// the digests of both outputs in r. Each build uses an empty build cache, so
+// that the second build cannot reuse the work of the first.
+func (b *Builder) verifyReproducible(ctx context.Context, r *Result) error {
+	cfg := r.Config
+	Logger.With(cfg.LogAttrs()...).Info("verifying")
+	b.Events.Emit(Event{Action: "build-started", Output: cfg.OutputPath()})
+	dir, err := os.MkdirTemp("", "build-variants-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	start := time.Now()
+	for _, sub := range []string{"a", "b"} {
+		output := filepath.Join(dir, sub, filepath.Base(cfg.OutputPath()))
+		cmd := cfg.cmd(ctx, output)
+		cmd.Env = append(cmd.Env, "GOCACHE="+filepath.Join(dir, sub, "cache"))
+		if err := runCmd(ctx, cmd); err != nil {
+			return err
+		}
+		sum, err := sha256File(output)
+		if err != nil {
+			return err
+		}
+		r.Digests = append(r.Digests, sum)
+	}
+	r.Duration = time.Since(start)
+	return nil
+}
+
+// SizeReport compares the sizes of successfully built outputs. Grouped by
+// target platform, it shows each output next to its size difference relative
+// to the baseline build of the same configuration with internal linking, no
+// stripping and no -trimpath.
+type SizeReport []Result
+
+// baselineKey returns the output path of the baseline build of c, which
+// SizeReport compares c to.
+func baselineKey(c Config) string {
+	c.LinkMode = "internal"
+	c.StripDebug = false
+	c.TrimPath = false
+	// Configurations with -trimpath also get -buildvcs=false, see
+	// MatrixSpec.Expand, which their baseline does not.
+	c.BuildVCS = ""
+	return c.OutputPath()
+}
+
+func (r SizeReport) String() string {
+	var built []Result
+	baseline := make(map[string]int64)
+	for _, res := range r {
+		if res.Err != nil {
+			continue
+		}
+		built = append(built, res)
+		if res.Config.LinkMode == "internal" && !res.Config.StripDebug && !res.Config.TrimPath {
+			baseline[baselineKey(res.Config)] = res.Size
+		}
+	}
+	sort.Slice(built, func(i, j int) bool {
+		ci, cj := built[i].Config, built[j].Config
+		if ci.GOOS != cj.GOOS {
+			return ci.GOOS < cj.GOOS
+		}
+		if ci.GOARCH != cj.GOARCH {
+			return ci.GOARCH < cj.GOARCH
+		}
+		return ci.OutputPath() < cj.OutputPath()
+	})
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	var platform string
+	for _, res := range built {
+		cfg := res.Config
+		if p := cfg.GOOS + "/" + cfg.GOARCH; p != platform {
+			platform = p
+			fmt.Fprintf(w, "%s\n", platform)
+			fmt.Fprintf(w, "  SIZE\tDELTA\tCOMPRESSED\tOUTPUT\n")
+		}
+		delta := "-"
+		if size, ok := baseline[baselineKey(cfg)]; ok && size > 0 {
+			delta = fmt.Sprintf("%+.1f%%", float64(res.Size-size)/float64(size)*100)
+		}
+		compressed := "-"
+		if res.CompressedSize > 0 {
+			compressed = strconv.FormatInt(res.CompressedSize, 10)
+		}
+		fmt.Fprintf(w, "  %d\t%s\t%s\t%s\n", res.Size, delta, compressed, filepath.Base(cfg.OutputPath()))
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// minStripSaving is the fraction of the size of an output below which the
+// saving of stripping it is not worth a separate variant.
+const minStripSaving = 0.01
+
+// LogIneffectiveStrip logs the stripped outputs in results that are not
+// meaningfully smaller than the output of the same configuration built without
+// stripping, such as for build modes whose outputs have no symbol table or
+// debug information to begin with. These variants can be pruned from the
+// matrix.
+func LogIneffectiveStrip(results []Result) {
+	unstripped := make(map[string]int64)
+	for _, r := range results {
+		if r.Err == nil && !r.Config.StripDebug {
+			unstripped[r.Config.OutputPath()] = r.Size
+		}
+	}
+	for _, r := range results {
+		if r.Err != nil || !r.Config.StripDebug {
+			continue
+		}
+		// Unlike -trimpath, stripping does not change -buildvcs, so
+		// the unstripped build differs only in StripDebug.
+		base := r.Config
+		base.StripDebug = false
+		size, ok := unstripped[base.OutputPath()]
+		if !ok || size == 0 {
+			continue
+		}
+		if float64(size-r.Size) < minStripSaving*float64(size) {
+			Logger.Info("stripping made no meaningful difference", append(r.Config.LogAttrs(), "size", r.Size, "unstripped", size)...)
+		}
+	}
+}
+
+// CompressionReport shows how much compression saved for each successfully
+// built output with a compressed copy, largest saving first, and in total. It
+// is empty if no output was compressed.
+type CompressionReport []Result
+
+func (r CompressionReport) String() string {
+	var compressed []Result
+	for _, res := range r {
+		if res.Err == nil && res.CompressedSize > 0 {
+			compressed = append(compressed, res)
+		}
+	}
+	if len(compressed) == 0 {
+		return ""
+	}
+	sort.Slice(compressed, func(i, j int) bool {
+		si := compressed[i].Size - compressed[i].CompressedSize
+		sj := compressed[j].Size - compressed[j].CompressedSize
+		if si != sj {
+			return si > sj
+		}
+		return compressed[i].Config.OutputPath() < compressed[j].Config.OutputPath()
+	})
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "SIZE\tCOMPRESSED\tSAVED\tOUTPUT\n")
+	var size, compressedSize int64
+	for _, res := range compressed {
+		size += res.Size
+		compressedSize += res.CompressedSize
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", res.Size, res.CompressedSize,
+			saving(res.Size, res.CompressedSize), filepath.Base(res.Config.OutputPath()))
+	}
+	fmt.Fprintf(w, "%d\t%d\t%s\ttotal of %d outputs\n", size, compressedSize, saving(size, compressedSize), len(compressed))
+	w.Flush()
+	return buf.String()
+}
+
+// saving formats how many bytes, and which percentage of size, compressing
+// to compressed saves.
+func saving(size, compressed int64) string {
+	if size == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d (%.1f%%)", size-compressed, float64(size-compressed)/float64(size)*100)
+}
+
+// releasesURL lists the Go releases, newest first. Without include=all, only
+// the two supported minor versions are listed.
+const releasesURL = "https://go.dev/dl/?mode=json&include=all"
+
+// releasesTTL is how long the list of Go releases is cached for.
+const releasesTTL = time.Hour
+
+// GoReleases returns the versions of the stable Go releases, newest first. The
+// list is fetched from releasesURL at most once per releasesTTL, and cached in
+// the user cache directory in between.
+func GoReleases(ctx context.Context) ([]string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cache := filepath.Join(dir, "go-build-variants", "releases.json")
+	var b []byte
+	if fi, err := os.Stat(cache); err == nil && time.Since(fi.ModTime()) < releasesTTL {
+		b, _ = os.ReadFile(cache)
+	}
+	if b == nil {
+		b, err = fetchReleases(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(cache), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(cache, b, 0644); err != nil {
+			return nil, err
+		}
+	}
+	var releases []struct {
+		Version string
+		Stable  bool
+	}
+	if err := json.Unmarshal(b, &releases); err != nil {
+		return nil, fmt.Errorf("%s: %v", releasesURL, err)
+	}
+	var versions []string
+	for _, r := range releases {
+		if r.Stable {
+			versions = append(versions, r.Version)
+		}
+	}
+	return versions, nil
+}
+
+// fetchReleases returns the list of Go releases at releasesURL.
+func fetchReleases(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", releasesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", releasesURL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// PatchVersion returns the patch version number of a Go version, such as 2
+// for go1.14.2 and 0 for go1.14, or -1 for pre-releases such as go1.21rc2.
+func PatchVersion(version string) int {
+	rest := strings.TrimPrefix(version, "go1.")
+	i := 0
+	for i < len(rest) && '0' <= rest[i] && rest[i] <= '9' {
+		i++
+	}
+	if i == len(rest) {
+		return 0
+	}
+	if p, err := strconv.Atoi(rest[i+1:]); err == nil && rest[i] == '.' {
+		return p
+	}
+	return -1
+}
+
+// LatestPatches returns versions with each version replaced by the newest
+// patch release of its minor version among releases, leaving out duplicates.
+// Toolchain paths and tip are kept as they are.
+func LatestPatches(versions, releases []string) ([]string, error) {
+	var latest []string
+	seen := make(map[string]bool)
+	for _, version := range versions {
+		if IsToolchainPath(version) || version == Tip {
+			latest = append(latest, version)
+			continue
+		}
+		minor, err := MinorVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		newest := ""
+		for _, r := range releases {
+			if v, err := MinorVersion(r); err == nil && v == minor && (newest == "" || PatchVersion(r) > PatchVersion(newest)) {
+				newest = r
+			}
+		}
+		if newest == "" {
+			return nil, fmt.Errorf("no release of %s found", version)
+		}
+		if newest != version {
+			Logger.Info("resolved latest patch release", "goversion", version, "latest", newest)
+		}
+		if !seen[newest] {
+			seen[newest] = true
+			latest = append(latest, newest)
+		}
+	}
+	return latest, nil
+}
+
+// InstallMissingToolchains takes a list of Go versions (in go1.x[.x] format,
+// or tip) and installs toolchains that are not available locally. Toolchains are
+// downloaded concurrently, while installing their wrapper commands with go
+// install is serialized since concurrent go install invocations may conflict
+// with each other. Each version is installed while holding a lock file, such that
+// concurrent runs of this program wait for each other instead of installing the
+// same toolchain at once, and toolchains installed in the meantime are not
+// installed again. It returns an error describing every toolchain that failed
+// to install.
+func InstallMissingToolchains(ctx context.Context, versions []string) error {
+	var (
+		installMu sync.Mutex
+		errMu     sync.Mutex
+		errs      []string
+		wg        sync.WaitGroup
+	)
+	sem := make(chan struct{}, runtime.NumCPU())
+	seen := make(map[string]bool)
+	for _, version := range versions {
+		if seen[version] {
+			continue
+		}
+		seen[version] = true
+		if IsToolchainPath(version) {
+			if _, err := GoVersion(version); err != nil {
+				// Toolchains given by path cannot be downloaded.
+				errMu.Lock()
+				errs = append(errs, fmt.Sprintf("checking %s: %v", version, err))
+				errMu.Unlock()
+			}
+			continue
+		}
+		if installed, err := GoVersion(version); err == nil && VersionMatches(version, installed) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(version string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			unlock, err := lockToolchain(ctx, version)
+			if err != nil {
+				errMu.Lock()
+				errs = append(errs, fmt.Sprintf("installing %s: %v", version, err))
+				errMu.Unlock()
+				return
+			}
+			defer unlock()
+			if installed, err := GoVersion(version); err == nil && VersionMatches(version, installed) {
+				// installed by another run while waiting for the lock
+				return
+			}
+			Logger.Info("installing", "goversion", version)
+			// Outside of a module, go get no longer installs
+			// commands since go1.18.
+			wrapper := "golang.org/dl/" + version + "@latest"
+			installMu.Lock()
+			err = retry(ctx, "go install "+wrapper, func() error {
+				return run(ctx, "go", "install", wrapper)
+			})
+			installMu.Unlock()
+			if err == nil {
+				err = retry(ctx, version+" download", func() error {
+					return run(ctx, version, "download")
+				})
+			}
+			if err == nil && version != Tip {
+				// There is no release that tip could be checked
+				// against.
+				err = verifyToolchain(version)
+			}
+			if err != nil {
+				errMu.Lock()
+				errs = append(errs, fmt.Sprintf("installing %s: %v", version, err))
+				errMu.Unlock()
+			}
+		}(version)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("failed to install toolchains:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// lockToolchain creates a lock file for installing the toolchain of version
+// in the directory where golang.org/dl commands install SDKs, waiting while
+// another process holds it, and returns a function removing it. Locks older
+// than an installation may take, with its retries, are left over by a process
+// that died and are taken over.
+func lockToolchain(ctx context.Context, version string) (unlock func(), err error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(home, "sdk")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, version+".lock")
+	stale := 2 * time.Duration(Retries+1) * Timeout
+	waiting := false
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > stale {
+			Logger.Warn("removing stale toolchain install lock", "lock", path)
+			os.Remove(path)
+			continue
+		}
+		if !waiting {
+			Logger.Info("waiting for another install", "goversion", version, "lock", path)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// verifyToolchain checks that a freshly installed toolchain is the requested
+// release: both its go version output and the VERSION file in its GOROOT must
+// name exactly version. The download command already checks the SDK archive
+// against the SHA-256 digest published by Go before unpacking it, and removes
+// the archive afterwards, so the archive itself cannot be checked again here.
+func verifyToolchain(version string) error {
+	reported, err := GoVersion(version)
+	if err != nil {
+		return err
+	}
+	if reported != version {
+		return fmt.Errorf("toolchain reports version %s, want %s", reported, version)
+	}
+	b, err := exec.Command(version, "env", "GOROOT").Output()
+	if err != nil {
+		return fmt.Errorf("%s env GOROOT: %v", version, err)
+	}
+	goroot := strings.TrimSpace(string(b))
+	b, err = os.ReadFile(filepath.Join(goroot, "VERSION"))
+	if err != nil {
+		return err
+	}
+	// The first line of VERSION is the version, possibly followed by other
+	// lines such as the release time.
+	if v := strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0]); v != version {
+		return fmt.Errorf("%s: version %s, want %s", filepath.Join(goroot, "VERSION"), v, version)
+	}
+	return nil
+}
+
+// compress compresses exe into compressedPath(exe, method, upxLevel), leaving
+// the original intact. The method is one of:
+//
+//	upx:  a self-extracting executable compressed with upx at upxLevel
+//	gzip: a gzip file
+//	zstd: a zstd file compressed with the zstd command
+func compress(ctx context.Context, exe, method, upxLevel string) error {
+	out := compressedPath(exe, method, upxLevel)
+	switch method {
+	case "upx":
+		args := []string{"-qq", "-f"}
+		if upxLevel != "" {
+			args = append(args, UPXOption(upxLevel))
+		}
+		return run(ctx, "upx", append(args, "-o", out, exe)...)
+	case "gzip":
+		return gzipFile(out, exe)
+	case "zstd":
+		return run(ctx, "zstd", "-q", "-f", "-o", out, exe)
+	}
+	return fmt.Errorf("unknown compression method %q", method)
+}
+
+// UPXOption returns the upx command line option selecting the compression
+// level, such as -9 for 9 or --brute for brute, or the empty string if level
+// is not a valid level.
+func UPXOption(level string) string {
+	switch level {
+	case "1", "2", "3", "4", "5", "6", "7", "8", "9":
+		return "-" + level
+	case "best", "brute", "ultra-brute", "lzma":
+		return "--" + level
+	}
+	return ""
+}
+
+// CheckUPXOption returns an error if the installed upx does not support
+// option, as older versions lack --ultra-brute and --lzma. Every upx supports
+// the numbered levels, though its help lists only some of them, so only named
+// levels are looked up in the help.
+func CheckUPXOption(option string) error {
+	if !strings.HasPrefix(option, "--") {
+		return nil
+	}
+	help, err := exec.Command("upx", "--help").Output()
+	if err != nil {
+		return fmt.Errorf("upx --help: %v", err)
+	}
+	for _, f := range strings.Fields(string(help)) {
+		if f == option {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not supported by the installed upx", option)
+}
+
+// compressedPath returns the path where compress writes the version of exe
+// compressed with method, at upxLevel for upx. The level is part of the name,
+// so that copies compressed at another level are not taken for cached ones.
+func compressedPath(exe, method, upxLevel string) string {
+	switch method {
+	case "gzip":
+		return exe + ".gz"
+	case "zstd":
+		return exe + ".zst"
+	case "upx":
+		method += alnum(upxLevel)
+	}
+	for _, ext := range []string{".exe", ".dll", ".dylib", ".so"} {
+		if strings.HasSuffix(exe, ext) {
+			return strings.TrimSuffix(exe, ext) + "-" + method + ext
+		}
+	}
+	return exe + "-" + method
+}
+
+// gzipFile writes a gzip-compressed copy of the file src to dst.
+func gzipFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	zw.Name = filepath.Base(src)
+	if _, err := io.Copy(zw, in); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// PackageOutputs bundles the outputs of successful builds into an archive per
+// name, Go version and platform, named name_goversion_goos_goarch with the
+// extension of format, tar.gz or zip, except that windows outputs are always
+// zipped. Each archive also contains the extra files. It returns the paths of
+// the archives.
+func PackageOutputs(results []Result, format string, extra []string) ([]string, error) {
+	bundles := make(map[string][]string)
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		cfg := r.Config
+		ext := "." + format
+		if cfg.GOOS == "windows" {
+			ext = ".zip"
+		}
+		path := filepath.Join(Out, fmt.Sprintf("%s_%s_%s_%s%s", cfg.Name, cfg.GoVersion, cfg.GOOS, cfg.GOARCH, ext))
+		bundles[path] = append(bundles[path], cfg.OutputPath())
+	}
+	var archives []string
+	for path, files := range bundles {
+		sort.Strings(files)
+		if err := writeArchive(path, append(files, extra...)); err != nil {
+			return archives, err
+		}
+		archives = append(archives, path)
+	}
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// writeArchive writes a tar.gz or zip archive, depending on the extension of
+// dst, containing the files by their base names. For reproducibility,
+// entries have zeroed timestamps and ownership, and their modes only tell
+// apart executables.
+func writeArchive(dst string, files []string) (err error) {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if strings.HasSuffix(dst, ".zip") {
+		zw := zip.NewWriter(f)
+		for _, file := range files {
+			b, fi, err := readArchiveEntry(file)
+			if err != nil {
+				return err
+			}
+			h := &zip.FileHeader{
+				Name:     filepath.Base(file),
+				Method:   zip.Deflate,
+				Modified: time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), // earliest zip time
+			}
+			h.SetMode(archiveMode(fi))
+			w, err := zw.CreateHeader(h)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		b, fi, err := readArchiveEntry(file)
+		if err != nil {
+			return err
+		}
+		h := &tar.Header{
+			Name:    filepath.Base(file),
+			Mode:    int64(archiveMode(fi)),
+			Size:    int64(len(b)),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatUSTAR,
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// readArchiveEntry returns the contents and file info of the file at path.
+func readArchiveEntry(path string) ([]byte, os.FileInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := os.ReadFile(path)
+	return b, fi, err
+}
+
+// archiveMode returns the mode of the archive entry of a file: 0755 if it is
+// executable by its owner, or 0644.
+func archiveMode(fi os.FileInfo) os.FileMode {
+	if fi.Mode()&0100 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// fileExists reports whether a file exists at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// run runs the command with the given name and arguments, and returns an error
+// if the execution failed.
+func run(ctx context.Context, name string, arg ...string) error {
+	return runCmd(ctx, exec.Command(name, arg...))
+}
+
+// retry calls f, which performs the step described by what, until it
+// succeeds, up to Retries more times after the first failure, doubling the
+// delay between attempts. It stops early if ctx is done. Only steps whose
+// failures may be transient, such as downloads, should be retried: compile
+// errors are deterministic.
+func retry(ctx context.Context, what string, f func() error) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt == Retries || ctx.Err() != nil {
+			return err
+		}
+		Logger.Warn("retrying", "step", what, "err", err, "delay", delay, "attempt", attempt+1, "retries", Retries)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// runCmd runs the cmd command, killing it if ctx is done or if it runs for
+// longer than Timeout. If the execution failed, it logs the command and its
+// combined output and returns the error.
+func runCmd(ctx context.Context, cmd *exec.Cmd) error {
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	err := wait(ctx, cmd)
+	if err != nil && ctx.Err() == nil {
+		Logger.Error("command failed", "cmd", cmd.String(), "err", err, "output", b.String())
+	}
+	return err
+}
+
+// runCmdLog runs the cmd command like runCmd, but writes the command and its
+// combined output to the file logPath instead of logging them, even if the
+// execution succeeded.
+func runCmdLog(ctx context.Context, cmd *exec.Cmd, logPath string) error {
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "$ %s\n", cmd)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	err = wait(ctx, cmd)
+	if err != nil && ctx.Err() == nil {
+		Logger.Error("command failed", "cmd", cmd.Args[0], "err", err, "log", logPath)
+	}
+	return err
+}
+
+// ErrTotalTimeout is the cause to cancel the context of a run with once the
+// whole run takes too long, see context.WithTimeoutCause. Commands canceled
+// with it fail with it.
+var ErrTotalTimeout = errors.New("run timed out, see -timeout-total")
+
+// wait starts the cmd command and waits for it to exit, killing it if ctx is
+// done or if it runs for longer than Timeout.
+func wait(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+	if err != nil {
+		if context.Cause(ctx) == ErrTotalTimeout {
+			return ErrTotalTimeout
+		}
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return fmt.Errorf("timed out after %v, see -timeout", Timeout)
+		case context.Canceled:
+			return fmt.Errorf("interrupted")
+		}
+	}
+	return err
+}